@@ -19,9 +19,57 @@ type DBConfig struct {
 	TSLConfig            string
 	AllowNativePasswords bool
 	MultiStatements      bool
-	MaxOpenConns         uint
-	MaxIdleConns         uint
-	ConnMaxLifetime      uint
+
+	// Connection pool, 0 MaxOpenConns means unlimited and 0 MaxIdleConns keeps no idle connection.
+	// ConnMaxLifetime and ConnMaxIdleTime are in second(s), 0 never expires connections
+	MaxOpenConns    uint
+	MaxIdleConns    uint
+	ConnMaxLifetime uint
+	ConnMaxIdleTime uint
+
+	// Driver timeouts in second(s), 0 waits indefinitely
+	ConnectTimeout uint
+	ReadTimeout    uint
+	WriteTimeout   uint
+
+	// Read replicas as host or host:port, DBPort is used when the port is omitted. Replicas share the credentials,
+	// database name and pool settings of the primary
+	ReplicaHosts []string
+
+	// Replicas lagging behind the primary by more than ReplicaMaxLag second(s) stop receiving reads, default to 10 seconds.
+	// Their health and lag are checked every ReplicaCheckInterval second(s), default to 5 seconds
+	ReplicaMaxLag        uint
+	ReplicaCheckInterval uint
+
+	// GORM queries are logged at GORMLogLevel (silent, error, warn or info), those taking longer than
+	// GORMSlowThreshold millisecond(s) are logged as warnings, 0 disables slow query logging. Only the info level logs
+	// the values of the queries
+	GORMLogLevel      string
+	GORMSlowThreshold uint
+
+	// GORMPrepareStmt caches prepared statements, GORMSkipDefaultTransaction stops GORM from wrapping
+	// single writes in a transaction and GORMDryRun generates the SQL without executing it.
+	// Statements are prepared on the primary, so GORMPrepareStmt sends every GORM read to the primary
+	GORMPrepareStmt            bool
+	GORMSkipDefaultTransaction bool
+	GORMDryRun                 bool
+
+	// Naming strategy of the tables, GORMTablePrefix is prepended to every table name
+	GORMTablePrefix   string
+	GORMSingularTable bool
+
+	// QueryTracing records the duration, rows and caller of every statement into per query statistics, default to false.
+	// Statements taking longer than SlowQueryThreshold millisecond(s) are logged, 0 disables slow query logging
+	QueryTracing       bool
+	SlowQueryThreshold uint
+
+	// InitMariaDB retries for up to StartupTimeout second(s) while the server is unreachable, 0 fails on the first
+	// attempt. Retries start StartupRetryInterval millisecond(s) apart and back off exponentially
+	StartupTimeout       uint
+	StartupRetryInterval uint
+
+	// The connection is checked every MonitorInterval second(s) to log when it is lost and recovered, 0 disables it
+	MonitorInterval uint
 }
 
 type RedisConfig struct {
@@ -30,6 +78,11 @@ type RedisConfig struct {
 	RedisPassword   string
 	RedisDBNum      uint8
 	RedisExpiration uint
+
+	// Startup retry and connection monitor of redis, see the fields of the same name in DBConfig
+	RedisStartupTimeout       uint
+	RedisStartupRetryInterval uint
+	RedisMonitorInterval      uint
 }
 
 type WebsocketConfig struct {
@@ -56,6 +109,19 @@ type SecurityConfig struct {
 
 	// Password minimal length, default to 8
 	PasswordMinLength uint32
+
+	// Key used to sign media download URLs
+	MediaURLKey string
+
+	// Media download URL life span in minute(s), default to 15 minutes
+	MediaURLLifeSpan uint32
+
+	// Keys used to encrypt media at rest by version, formatted as version:base64key pairs (e.g. 1:key;2:key).
+	// Keys must decode to 16, 24 or 32 bytes, old versions are kept to read the media they encrypted
+	MediaEncryptionKeys map[string]string
+
+	// Version of MediaEncryptionKeys used to encrypt new media
+	MediaEncryptionKeyVersion uint
 }
 
 type SSLConfig struct {
@@ -64,8 +130,60 @@ type SSLConfig struct {
 }
 
 type FileHandlingConfig struct {
+	// Maximum size of a single uploaded file in MB, 0 disables the limit
 	MaxFileSize  uint
 	FileRootPath string
+
+	// Allowed MIME types per file category (photos, applications, videos, audios, plaintexts, others).
+	// Categories without an entry accept every type, wildcards such as image/* are supported. Executables and scripts
+	// are only accepted when their exact type is listed
+	AllowedMIMETypes map[string][]string
+
+	// Declared MIME types per file category accepted when their content isn't recognized by sniffing, such as
+	// application/x-7z-compressed. Any other unrecognized content is rejected
+	GenericContentTypes map[string][]string
+
+	// Maximum size per file category in MB, categories without an entry fall back to MaxFileSize
+	CategoryMaxFileSize map[string]uint
+
+	// Image variants generated for photo uploads, mapping the variant name to the maximum width/height in pixels
+	// (e.g. thumbnail:200;medium:800). No variant is generated when empty
+	ImageVariants map[string]uint
+
+	// How stored files are named, either "uuid" or "hash", default to uuid.
+	// The client supplied filename is only kept as metadata in File.Filename
+	NamingStrategy string
+
+	// Store files on a path derived from their content hash so identical uploads share one file
+	ContentAddressed bool
+
+	// Life span of an idle resumable upload session in minute(s), default to 1440 minutes, 0 falls back to the default
+	UploadSessionExpiration uint
+
+	// Storage backend used to persist files, either "local" or "s3", default to local
+	StorageBackend string
+
+	// S3 compatible object storage, only used when StorageBackend is set to s3
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3UseSSL       bool
+	S3UsePathStyle bool
+
+	// Malware scanner run on every upload before it is saved, either "" (disabled) or "clamav". The scanner is part
+	// of the readiness health check
+	ScannerBackend string
+
+	// Accept uploads when the scanner can't be reached, they are saved with a failed scan status
+	ScanFailOpen bool
+
+	// clamd daemon, only used when ScannerBackend is set to clamav. Network is either tcp or unix,
+	// timeout in second(s), default to 30 seconds
+	ClamAVNetwork string
+	ClamAVAddress string
+	ClamAVTimeout uint
 }
 
 type AppConfig struct {
@@ -104,9 +222,34 @@ func New(envPath string) *AppConfig {
 			TSLConfig:            getEnv("DB_TLS_CONFIG", "true"),
 			AllowNativePasswords: getEnvAsBool("DB_ALLOW_NATIVE_PASSWORDS", true),
 			MultiStatements:      getEnvAsBool("DB_MULTI_STATEMENTS", false),
-			MaxOpenConns:         uint(getEnvAsInt("DB_MAX_OPEN_CONNS", 20)),
-			MaxIdleConns:         uint(getEnvAsInt("DB_MAX_IDLE_CONNS", 5)),
-			ConnMaxLifetime:      uint(getEnvAsInt("DB_CONN_MAX_LIFETIME", 5)),
+
+			MaxOpenConns:    uint(getEnvAsInt("DB_MAX_OPEN_CONNS", 20)),
+			MaxIdleConns:    uint(getEnvAsInt("DB_MAX_IDLE_CONNS", 5)),
+			ConnMaxLifetime: uint(getEnvAsInt("DB_CONN_MAX_LIFETIME", 5)),
+			ConnMaxIdleTime: uint(getEnvAsInt("DB_CONN_MAX_IDLE_TIME", 0)),
+
+			ConnectTimeout: uint(getEnvAsInt("DB_CONNECT_TIMEOUT", 10)),
+			ReadTimeout:    uint(getEnvAsInt("DB_READ_TIMEOUT", 0)),
+			WriteTimeout:   uint(getEnvAsInt("DB_WRITE_TIMEOUT", 0)),
+
+			ReplicaHosts:         getEnvAsSlice("DB_REPLICA_HOSTS", []string{}, ","),
+			ReplicaMaxLag:        uint(getEnvAsInt("DB_REPLICA_MAX_LAG", 10)),
+			ReplicaCheckInterval: uint(getEnvAsInt("DB_REPLICA_CHECK_INTERVAL", 5)),
+
+			GORMLogLevel:               getEnv("DB_GORM_LOG_LEVEL", "warn"),
+			GORMSlowThreshold:          uint(getEnvAsInt("DB_GORM_SLOW_THRESHOLD", 200)),
+			GORMPrepareStmt:            getEnvAsBool("DB_GORM_PREPARE_STMT", false),
+			GORMSkipDefaultTransaction: getEnvAsBool("DB_GORM_SKIP_DEFAULT_TRANSACTION", false),
+			GORMDryRun:                 getEnvAsBool("DB_GORM_DRY_RUN", false),
+			GORMTablePrefix:            getEnv("DB_GORM_TABLE_PREFIX", ""),
+			GORMSingularTable:          getEnvAsBool("DB_GORM_SINGULAR_TABLE", false),
+
+			QueryTracing:       getEnvAsBool("DB_QUERY_TRACING", false),
+			SlowQueryThreshold: uint(getEnvAsInt("DB_SLOW_QUERY_THRESHOLD", 1000)),
+
+			StartupTimeout:       uint(getEnvAsInt("DB_STARTUP_TIMEOUT", 30)),
+			StartupRetryInterval: uint(getEnvAsInt("DB_STARTUP_RETRY_INTERVAL", 500)),
+			MonitorInterval:      uint(getEnvAsInt("DB_MONITOR_INTERVAL", 10)),
 		},
 		RedisConfig: RedisConfig{
 			RedisHost:       getEnv("REDIS_HOST", ""),
@@ -114,6 +257,10 @@ func New(envPath string) *AppConfig {
 			RedisPassword:   getEnv("REDIS_PASSWORD", ""),
 			RedisDBNum:      uint8(getEnvAsInt("REDIS_DB_NUM", 0)),
 			RedisExpiration: uint(getEnvAsInt("REDIS_EXPIRATION", 0)),
+
+			RedisStartupTimeout:       uint(getEnvAsInt("REDIS_STARTUP_TIMEOUT", 30)),
+			RedisStartupRetryInterval: uint(getEnvAsInt("REDIS_STARTUP_RETRY_INTERVAL", 500)),
+			RedisMonitorInterval:      uint(getEnvAsInt("REDIS_MONITOR_INTERVAL", 10)),
 		},
 		WebsocketConfig: WebsocketConfig{
 			WSURL:               getEnv("WS_URL", ""),
@@ -133,6 +280,11 @@ func New(envPath string) *AppConfig {
 			JWTKey:            getEnv("JWT_KEY", ""),
 			JWTLifeSpan:       uint32(getEnvAsInt("JWT_LIFE_SPAN", 1)),
 			PasswordMinLength: uint32(getEnvAsInt("PASSWORD_MIN_LENGTH", 8)),
+			MediaURLKey:       getEnv("MEDIA_URL_KEY", ""),
+			MediaURLLifeSpan:  uint32(getEnvAsInt("MEDIA_URL_LIFE_SPAN", 15)),
+
+			MediaEncryptionKeys:       getEnvAsMap("MEDIA_ENCRYPTION_KEYS", nil),
+			MediaEncryptionKeyVersion: uint(getEnvAsInt("MEDIA_ENCRYPTION_KEY_VERSION", 1)),
 		},
 		SSLConfig: SSLConfig{
 			KeyPath:  getEnv("KEY_PATH", ""),
@@ -141,6 +293,30 @@ func New(envPath string) *AppConfig {
 		FileHandlingConfig: FileHandlingConfig{
 			MaxFileSize:  uint(getEnvAsInt("MAX_FILE_SIZE", 1024)),
 			FileRootPath: getEnv("FILE_ROOT_PATH", "./files"),
+
+			AllowedMIMETypes:    getEnvAsSliceMap("FILE_ALLOWED_MIME_TYPES", nil),
+			GenericContentTypes: getEnvAsSliceMap("FILE_GENERIC_CONTENT_TYPES", nil),
+			CategoryMaxFileSize: getEnvAsUintMap("FILE_CATEGORY_MAX_SIZE", nil),
+			ImageVariants:       getEnvAsUintMap("FILE_IMAGE_VARIANTS", nil),
+			NamingStrategy:      getEnv("FILE_NAMING_STRATEGY", "uuid"),
+			ContentAddressed:    getEnvAsBool("FILE_CONTENT_ADDRESSED", false),
+
+			UploadSessionExpiration: uint(getEnvAsInt("UPLOAD_SESSION_EXPIRATION", 1440)),
+
+			StorageBackend: getEnv("FILE_STORAGE_BACKEND", "local"),
+			S3Endpoint:     getEnv("S3_ENDPOINT", ""),
+			S3Region:       getEnv("S3_REGION", "us-east-1"),
+			S3Bucket:       getEnv("S3_BUCKET", ""),
+			S3AccessKey:    getEnv("S3_ACCESS_KEY", ""),
+			S3SecretKey:    getEnv("S3_SECRET_KEY", ""),
+			S3UseSSL:       getEnvAsBool("S3_USE_SSL", true),
+			S3UsePathStyle: getEnvAsBool("S3_USE_PATH_STYLE", true),
+
+			ScannerBackend: getEnv("FILE_SCANNER_BACKEND", ""),
+			ScanFailOpen:   getEnvAsBool("FILE_SCAN_FAIL_OPEN", false),
+			ClamAVNetwork:  getEnv("CLAMAV_NETWORK", "tcp"),
+			ClamAVAddress:  getEnv("CLAMAV_ADDRESS", "localhost:3310"),
+			ClamAVTimeout:  uint(getEnvAsInt("CLAMAV_TIMEOUT", 30)),
 		},
 		AppMode:     getEnv("APP_MODE", "devs"),
 		AppLanguage: getEnv("APP_LANG", "en"),
@@ -219,3 +395,64 @@ func getEnvAsSlice[T any](name string, defaultVal []T, sep string) []T {
 
 	return result
 }
+
+// Helper to read an environment variable formatted as key:value pairs separated by semicolons
+// (e.g. photos:10;videos:500) into a map or return default value.
+func getEnvAsMap(name string, defaultVal map[string]string) map[string]string {
+	valStr := getEnv(name, "")
+
+	if valStr == "" {
+		return defaultVal
+	}
+
+	result := make(map[string]string)
+	for _, pair := range strings.Split(valStr, ";") {
+		key, value, found := strings.Cut(pair, ":")
+		if !found || strings.TrimSpace(key) == "" {
+			continue
+		}
+		result[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return result
+}
+
+// Helper to read an environment variable formatted as key:value pairs whose values are comma separated
+// (e.g. photos:image/jpeg,image/png;applications:application/pdf) or return default value.
+func getEnvAsSliceMap(name string, defaultVal map[string][]string) map[string][]string {
+	pairs := getEnvAsMap(name, nil)
+
+	if pairs == nil {
+		return defaultVal
+	}
+
+	result := make(map[string][]string, len(pairs))
+	for key, value := range pairs {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result[key] = append(result[key], item)
+			}
+		}
+	}
+
+	return result
+}
+
+// Helper to read an environment variable formatted as key:value pairs with unsigned integer values
+// (e.g. photos:10;videos:500) or return default value.
+func getEnvAsUintMap(name string, defaultVal map[string]uint) map[string]uint {
+	pairs := getEnvAsMap(name, nil)
+
+	if pairs == nil {
+		return defaultVal
+	}
+
+	result := make(map[string]uint, len(pairs))
+	for key, value := range pairs {
+		if val, err := strconv.ParseUint(value, 10, 0); err == nil {
+			result[key] = uint(val)
+		}
+	}
+
+	return result
+}
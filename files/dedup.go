@@ -0,0 +1,319 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"path"
+	"sort"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// contentAddressedFolder holds the blobs when FileHandlingConfig.ContentAddressed is enabled
+	contentAddressedFolder = "blobs"
+
+	// tempUploadFolder holds uploads until they are scanned and their final path is known
+	tempUploadFolder = "tmp"
+)
+
+// FileMover is implemented by file stores that can move a file without reading it back,
+// stores that don't implement it have their files copied then deleted instead
+type FileMover interface {
+	Move(ctx context.Context, src, dst string) error
+}
+
+// contentAddressedPath returns the blob path derived from the file hash,
+// the first bytes of the hash are used as sub folders to avoid huge directories
+func contentAddressedPath(hashValue string) string {
+	return path.Join(contentAddressedFolder, hashValue[0:2], hashValue[2:4], hashValue)
+}
+
+// tempUploadPath returns a random path to stream an upload into
+func tempUploadPath() (string, error) {
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", eris.Wrap(err, "generating temporary file name")
+	}
+
+	return path.Join(tempUploadFolder, hex.EncodeToString(name)), nil
+}
+
+// moveFile moves a file within the store, using the store's own Move when supported
+func moveFile(ctx context.Context, store FileStore, src, dst string) error {
+	if mover, ok := store.(FileMover); ok {
+		return mover.Move(ctx, src, dst)
+	}
+
+	info, err := store.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	reader, err := store.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err = store.Put(ctx, dst, reader, info.Size); err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, src)
+}
+
+// promoteUpload moves a temporary upload to its final path once its hash is known. If a file already exists on that
+// path it holds identical content, so the temporary upload is dropped and the existing file is reused.
+// Created reports which one happened. The final path must be locked, see claimUpload
+func promoteUpload(ctx context.Context, tempPath, finalPath string) (created bool, err error) {
+	store := GetFileStore()
+
+	_, err = store.Stat(ctx, finalPath)
+	switch {
+	case err == nil:
+		// Identical content is already stored, keep the existing file
+		if err = store.Delete(ctx, tempPath); err != nil {
+			return false, eris.Wrap(err, "removing duplicate upload")
+		}
+		return false, nil
+	case errors.Is(err, ErrFileNotFound):
+		if err = moveFile(ctx, store, tempPath, finalPath); err != nil {
+			return false, eris.Wrap(err, "moving upload to its final path")
+		}
+		return true, nil
+	default:
+		return false, eris.Wrap(err, "checking existing file")
+	}
+}
+
+// lockFilePaths locks the given file paths until the end of the transaction. The rows are locked in a stable order
+// so transactions locking overlapping paths don't deadlock
+func lockFilePaths(gormTx *gorm.DB, filePaths []string) error {
+	locks := make([]MediaFileLock, 0, len(filePaths))
+	seen := make(map[string]bool, len(filePaths))
+	for _, filePath := range filePaths {
+		if filePath == "" || seen[filePath] {
+			continue
+		}
+		seen[filePath] = true
+		locks = append(locks, MediaFileLock{FilePath: filePath})
+	}
+	if len(locks) == 0 {
+		return nil
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].FilePath < locks[j].FilePath })
+
+	// The upsert locks the existing rows exclusively and creates the missing ones
+	if result := gormTx.Clauses(clause.OnConflict{DoNothing: true}).Create(&locks); result.Error != nil {
+		return eris.Wrap(result.Error, "locking file paths")
+	}
+
+	return nil
+}
+
+// claimUpload locks the paths of the upload and of its variants for the transaction about to save its record, then
+// moves a staged upload to its final path. The existence of the final path is checked under the lock, so a file found
+// there can't be removed before the record referencing it is committed. The staged upload is removed on failure
+func claimUpload(ctx context.Context, gormTx *gorm.DB, upload *storedUpload) error {
+	filePaths := append([]string{upload.FilePath}, plannedVariantPaths(upload.File)...)
+	if err := lockFilePaths(gormTx, filePaths); err != nil {
+		discardUnclaimed(ctx, *upload)
+		return err
+	}
+
+	if upload.stagedPath == "" {
+		return nil
+	}
+
+	created, err := promoteUpload(ctx, upload.stagedPath, upload.FilePath)
+	if err != nil {
+		discardUnclaimed(ctx, *upload)
+		return err
+	}
+	upload.Created, upload.stagedPath = created, ""
+
+	return nil
+}
+
+// discardUnclaimed removes an upload claimUpload hasn't moved to a shared path yet
+func discardUnclaimed(ctx context.Context, upload storedUpload) {
+	switch {
+	case upload.stagedPath != "":
+		discardUpload(ctx, upload.stagedPath)
+	case upload.Created:
+		// Stored under a random path, no other record can use it
+		discardUpload(ctx, upload.FilePath)
+	}
+}
+
+// discardClaimed removes the files of a claimed upload whose record could not be saved. Shared paths go through
+// removeOrphanFiles since another upload may have claimed them once the lock was released
+func discardClaimed(ctx context.Context, tx *sql.Tx, upload storedUpload, variants []MediaVariant) {
+	if !upload.Created {
+		return
+	}
+
+	if !upload.shared {
+		discardUpload(ctx, upload.FilePath)
+		discardVariants(ctx, variants)
+		return
+	}
+
+	filePaths := []string{upload.FilePath}
+	for _, variant := range variants {
+		filePaths = append(filePaths, variant.FilePath)
+	}
+
+	if _, err := removeOrphanFiles(ctx, tx, filePaths); err != nil {
+		slog.Error("unable to clean up uploaded file", "path", upload.FilePath, "reason", err)
+	}
+}
+
+// detachVariants soft deletes the variants of the given media and returns the paths of their files
+func detachVariants(gormTx *gorm.DB, mediaIDs []uint) ([]string, error) {
+	if len(mediaIDs) == 0 {
+		return nil, nil
+	}
+
+	var variantPaths []string
+	result := gormTx.Model(&MediaVariant{}).Where("id_media IN ?", mediaIDs).Pluck("file_path", &variantPaths)
+	if result.Error != nil {
+		return nil, eris.Wrap(result.Error, "getting media variants")
+	}
+
+	if len(variantPaths) == 0 {
+		return nil, nil
+	}
+
+	if result = gormTx.Where("id_media IN ?", mediaIDs).Delete(&MediaVariant{}); result.Error != nil {
+		return nil, eris.Wrap(result.Error, "deleting media variants")
+	}
+
+	return variantPaths, nil
+}
+
+// orphanedFiles returns the original and variant files that are no longer referenced by any live record.
+// Run it inside the same transaction that removed the references so the removal is taken into account
+func orphanedFiles(gormTx *gorm.DB, filePaths, variantPaths []string) ([]string, error) {
+	orphans, err := unreferencedPaths(gormTx, &Media{}, filePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	variantOrphans, err := unreferencedPaths(gormTx, &MediaVariant{}, variantPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(orphans, variantOrphans...), nil
+}
+
+// unreferencedPaths returns the given file paths that are no longer referenced by any live record of the model
+func unreferencedPaths(gormTx *gorm.DB, model interface{}, filePaths []string) ([]string, error) {
+	if len(filePaths) == 0 {
+		return nil, nil
+	}
+
+	var referenced []string
+	result := gormTx.Model(model).Where("file_path IN ?", filePaths).Distinct().Pluck("file_path", &referenced)
+	if result.Error != nil {
+		return nil, eris.Wrap(result.Error, "counting file references")
+	}
+	inUse := make(map[string]bool, len(referenced))
+	for _, filePath := range referenced {
+		inUse[filePath] = true
+	}
+
+	var orphans []string
+	seen := make(map[string]bool, len(filePaths))
+	for _, filePath := range filePaths {
+		if filePath == "" || inUse[filePath] || seen[filePath] {
+			continue
+		}
+		seen[filePath] = true
+		orphans = append(orphans, filePath)
+	}
+
+	return orphans, nil
+}
+
+// isReferenced reports whether a live media or media variant references the file path. The matching rows are locked
+// so the latest committed references are seen even by a transaction started earlier
+func isReferenced(gormTx *gorm.DB, filePath string) (bool, error) {
+	for _, model := range []interface{}{&Media{}, &MediaVariant{}} {
+		var count int64
+		result := gormTx.Model(model).Clauses(clause.Locking{Strength: "UPDATE"}).Where("file_path = ?", filePath).Count(&count)
+		if result.Error != nil {
+			return false, eris.Wrap(result.Error, "counting file references")
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// removeOrphanFiles removes the given files from the file store and returns how many were removed. Each path is
+// locked and checked again right before its removal, an upload may have started reusing it since its references were
+// removed. Runs within tx when given, otherwise every path is removed in its own transaction
+func removeOrphanFiles(ctx context.Context, tx *sql.Tx, filePaths []string) (int, error) {
+	removed := 0
+	for _, filePath := range filePaths {
+		done, err := removeOrphanFile(ctx, tx, filePath)
+		if err != nil {
+			return removed, err
+		}
+		if done {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func removeOrphanFile(ctx context.Context, tx *sql.Tx, filePath string) (bool, error) {
+	gormTx := beginGormTx(ctx, tx)
+
+	if err := lockFilePaths(gormTx, []string{filePath}); err != nil {
+		rollbackGormTx(gormTx, tx)
+		return false, err
+	}
+
+	referenced, err := isReferenced(gormTx, filePath)
+	if err != nil || referenced {
+		rollbackGormTx(gormTx, tx)
+		return false, err
+	}
+
+	if err = GetFileStore().Delete(ctx, filePath); err != nil {
+		rollbackGormTx(gormTx, tx)
+		return false, eris.Wrap(err, "removing orphan file")
+	}
+
+	if result := gormTx.Delete(&MediaFileLock{FilePath: filePath}); result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		return false, eris.Wrap(result.Error, "removing file lock")
+	}
+
+	return true, commitGormTx(gormTx, tx)
+}
+
+// removeFiles deletes the given files from the file store
+func removeFiles(ctx context.Context, filePaths []string) error {
+	store := GetFileStore()
+	for _, filePath := range filePaths {
+		if err := store.Delete(ctx, filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
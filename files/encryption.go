@@ -0,0 +1,396 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with a header made of encryptedFileMagic and a random salt, followed by the content sealed
+// with AES-GCM in segments of encryptionSegmentSize bytes. Every file is sealed under its own key, derived from the
+// key version and the salt with HKDF-SHA256, so the segment counter alone keeps nonces unique. Segments are sealed
+// independently so files can be decrypted as a stream and seeked without reading everything before the requested range.
+//
+// Files written before the derived keys start with legacyEncryptedFileMagic and a random nonce prefix, and are
+// sealed with the key version itself. They can still be read
+const (
+	encryptedFileMagic          = "PME2"
+	encryptionSaltSize          = 32
+	encryptionHeaderSize        = len(encryptedFileMagic) + encryptionSaltSize
+	legacyEncryptedFileMagic    = "PME1"
+	legacyEncryptionHeaderSize  = len(legacyEncryptedFileMagic) + encryptionNoncePrefixSize
+	encryptionNoncePrefixSize   = 7
+	encryptionSegmentSize       = 64 * 1024
+	encryptionTagSize           = 16
+	encryptionKeyDerivationInfo = "panacea media encryption"
+)
+
+var (
+	ErrEncryptionKeyNotFound = eris.New("media encryption key not found")
+	ErrDecryptionFailed      = eris.New("unable to decrypt media, the file is corrupted or the key is wrong")
+)
+
+// currentEncryptionKeyVersion returns the key version used to encrypt new media
+func currentEncryptionKeyVersion() (uint, error) {
+	version := config.GetConfig().SecurityConfig.MediaEncryptionKeyVersion
+	if version == 0 {
+		return 0, eris.New("media encryption key version must be greater than zero")
+	}
+
+	return version, nil
+}
+
+// encryptionKey returns the key of the given version from SecurityConfig.MediaEncryptionKeys
+func encryptionKey(version uint) ([]byte, error) {
+	encoded := config.GetConfig().SecurityConfig.MediaEncryptionKeys[strconv.FormatUint(uint64(version), 10)]
+	if encoded == "" {
+		return nil, eris.Wrapf(ErrEncryptionKeyNotFound, "version %d", version)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, eris.Wrapf(err, "decoding media encryption key version %d", version)
+	}
+
+	return key, nil
+}
+
+// encryptionAEAD returns the cipher of a file sealed with the given key version and salt. A nil salt returns the
+// cipher of the key version itself, used by legacy files
+func encryptionAEAD(version uint, salt []byte) (cipher.AEAD, error) {
+	key, err := encryptionKey(version)
+	if err != nil {
+		return nil, err
+	}
+
+	if salt != nil {
+		// The derived key has the length of the key version, so both use the same AES variant
+		derived := make([]byte, len(key))
+		if _, err = io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(encryptionKeyDerivationInfo)), derived); err != nil {
+			return nil, eris.Wrapf(err, "deriving the file key of version %d", version)
+		}
+		key = derived
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, eris.Wrapf(err, "invalid media encryption key version %d", version)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptedSize returns the stored size of a file whose content is size bytes long
+func encryptedSize(size int64) int64 {
+	return int64(encryptionHeaderSize) + sealedSize(size)
+}
+
+// sealedSize returns the length of the sealed segments of a content of size bytes, without the header
+func sealedSize(size int64) int64 {
+	segments := max(1, (size+encryptionSegmentSize-1)/encryptionSegmentSize)
+	return size + segments*encryptionTagSize
+}
+
+// segmentNonce derives the nonce of a segment from its index, the prefix is only set by legacy files. The last
+// segment uses a distinct nonce so a file truncated on a segment boundary fails to decrypt
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, encryptionNoncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// sealReader encrypts r with the given key version, r is returned as is when version is 0.
+// Size is the length of r, or -1 if unknown, and the stored length is returned alongside the reader
+func sealReader(r io.Reader, size int64, version uint) (io.Reader, int64, error) {
+	if version == 0 {
+		return r, size, nil
+	}
+
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptedFileMagic)
+	if _, err := rand.Read(header[len(encryptedFileMagic):]); err != nil {
+		return nil, 0, eris.Wrap(err, "generating salt")
+	}
+
+	aead, err := encryptionAEAD(version, header[len(encryptedFileMagic):])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if size >= 0 {
+		size = encryptedSize(size)
+	}
+
+	return &encryptReader{
+		src:     bufio.NewReaderSize(r, encryptionSegmentSize),
+		aead:    aead,
+		header:  header,
+		pending: header,
+		plain:   make([]byte, encryptionSegmentSize),
+	}, size, nil
+}
+
+// encryptReader seals the content of src one segment at a time
+type encryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	index   uint32
+	pending []byte
+	plain   []byte
+	sealed  []byte
+	done    bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// seal reads and encrypts the next segment
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	// A full segment is only the last one when nothing follows it
+	last := err != nil
+	if !last {
+		if _, err = e.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce := segmentNonce(nil, e.index, last)
+	e.sealed = e.aead.Seal(e.sealed[:0], nonce, e.plain[:n], e.header)
+	e.pending = e.sealed
+	e.index++
+	e.done = last
+
+	return nil
+}
+
+// openEncrypted opens an encrypted stored file, the returned reader decrypts it on the fly and can be seeked
+func openEncrypted(ctx context.Context, file File) (*decryptReader, error) {
+	size := int64(file.Size)
+	storedSize := encryptedSize(size)
+	reader := &decryptReader{
+		size:    size,
+		segment: -1,
+		plain:   make([]byte, 0, encryptionSegmentSize),
+		sealed:  make([]byte, encryptionSegmentSize+encryptionTagSize),
+		open: func(offset int64) (io.ReadCloser, error) {
+			return openStoredAt(ctx, file.FilePath, offset, storedSize)
+		},
+	}
+
+	body, err := reader.open(0)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptedFileMagic), encryptionHeaderSize)
+	if _, err = io.ReadFull(body, header); err != nil {
+		body.Close()
+		return nil, ErrDecryptionFailed
+	}
+
+	var salt []byte
+	switch string(header) {
+	case encryptedFileMagic:
+		header = header[:encryptionHeaderSize]
+		salt = header[len(encryptedFileMagic):]
+	case legacyEncryptedFileMagic:
+		header = header[:legacyEncryptionHeaderSize]
+		reader.noncePrefix = header[len(legacyEncryptedFileMagic):]
+		storedSize = int64(legacyEncryptionHeaderSize) + sealedSize(size)
+	default:
+		body.Close()
+		return nil, ErrDecryptionFailed
+	}
+
+	if _, err = io.ReadFull(body, header[len(encryptedFileMagic):]); err != nil {
+		body.Close()
+		return nil, ErrDecryptionFailed
+	}
+
+	if reader.aead, err = encryptionAEAD(file.EncryptionKeyVersion, salt); err != nil {
+		body.Close()
+		return nil, err
+	}
+	reader.header = header
+	reader.body = body
+
+	return reader, nil
+}
+
+// openStoredAt opens a stored file starting at the given offset, size is the stored length of the file
+func openStoredAt(ctx context.Context, filePath string, offset, size int64) (io.ReadCloser, error) {
+	store := GetFileStore()
+
+	if rangeReader, ok := store.(FileRangeReader); ok && offset > 0 {
+		return rangeReader.GetRange(ctx, filePath, offset, size-offset)
+	}
+
+	reader, err := store.Get(ctx, filePath)
+	if err != nil || offset == 0 {
+		return reader, err
+	}
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, reader, offset)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, eris.Wrap(err, "skipping to the requested offset")
+	}
+
+	return reader, nil
+}
+
+// decryptReader decrypts an encrypted file one segment at a time. Seeking only moves the position,
+// the segment holding it is fetched on the next read
+type decryptReader struct {
+	aead   cipher.AEAD
+	open   func(offset int64) (io.ReadCloser, error)
+	header []byte
+	body   io.ReadCloser
+
+	// noncePrefix is only set by legacy files
+	noncePrefix []byte
+
+	// size is the length of the decrypted content
+	size   int64
+	offset int64
+
+	// segment is the index of the segment held in plain, -1 when none is
+	segment int64
+	plain   []byte
+	sealed  []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.offset / encryptionSegmentSize
+	if index != d.segment {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.offset-index*encryptionSegmentSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// load decrypts the segment with the given index, the body is only reopened when the segment isn't the next one
+func (d *decryptReader) load(index int64) error {
+	if d.body == nil || index != d.segment+1 {
+		d.reset()
+
+		body, err := d.open(int64(len(d.header)) + index*(encryptionSegmentSize+encryptionTagSize))
+		if err != nil {
+			return err
+		}
+		d.body = body
+	}
+
+	lastIndex := max(1, (d.size+encryptionSegmentSize-1)/encryptionSegmentSize) - 1
+	length := int64(encryptionSegmentSize)
+	if index == lastIndex {
+		length = d.size - index*encryptionSegmentSize
+	}
+
+	sealed := d.sealed[:length+encryptionTagSize]
+	if _, err := io.ReadFull(d.body, sealed); err != nil {
+		d.reset()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrDecryptionFailed
+		}
+		return eris.Wrap(err, "reading encrypted file")
+	}
+
+	nonce := segmentNonce(d.noncePrefix, uint32(index), index == lastIndex)
+	plain, err := d.aead.Open(d.plain[:0], nonce, sealed, d.header)
+	if err != nil {
+		d.reset()
+		return ErrDecryptionFailed
+	}
+	d.plain = plain
+	d.segment = index
+
+	return nil
+}
+
+// reset drops the body and the current segment, the next read reopens the file where it is needed
+func (d *decryptReader) reset() {
+	if d.body != nil {
+		d.body.Close()
+		d.body = nil
+	}
+	d.segment = -1
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = d.offset + offset
+	case io.SeekEnd:
+		target = d.size + offset
+	default:
+		return 0, eris.New("invalid whence")
+	}
+
+	if target < 0 {
+		return 0, eris.New("negative position")
+	}
+	d.offset = target
+
+	return target, nil
+}
+
+func (d *decryptReader) Close() error {
+	if d.body != nil {
+		return d.body.Close()
+	}
+
+	return nil
+}
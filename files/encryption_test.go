@@ -0,0 +1,265 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+func setTestEncryptionKeys(t *testing.T) {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	t.Setenv("MEDIA_ENCRYPTION_KEYS", "1:"+base64.StdEncoding.EncodeToString(key))
+	t.Setenv("MEDIA_ENCRYPTION_KEY_VERSION", "1")
+	config.New("/nonexistent")
+}
+
+// putEncrypted seals content with the key version 1 and stores it at filePath
+func putEncrypted(t *testing.T, store *LocalStore, filePath string, content []byte) File {
+	t.Helper()
+
+	sealed, storedSize, err := sealReader(bytes.NewReader(content), int64(len(content)), 1)
+	if err != nil {
+		t.Fatalf("sealReader: %v", err)
+	}
+	if err = store.Put(context.Background(), filePath, sealed, storedSize); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	return File{FilePath: filePath, Size: uint(len(content)), EncryptionKeyVersion: 1}
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("generating content: %v", err)
+	}
+
+	return content
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	setTestEncryptionKeys(t)
+	store := newTestLocalStore(t)
+
+	sizes := []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, encryptionSegmentSize*3 + 5}
+	for _, size := range sizes {
+		content := randomContent(t, size)
+		file := putEncrypted(t, store, filepath.Join("documents", "round-trip"), content)
+
+		stat, err := os.Stat(filepath.Join(store.root, file.FilePath))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if stat.Size() != encryptedSize(int64(size)) {
+			t.Fatalf("size %d: stored %d bytes, want %d", size, stat.Size(), encryptedSize(int64(size)))
+		}
+
+		reader, err := OpenFile(context.Background(), file)
+		if err != nil {
+			t.Fatalf("size %d: OpenFile: %v", size, err)
+		}
+		decrypted, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("size %d: reading: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestEncryptionUsesAFreshKeyPerFile(t *testing.T) {
+	setTestEncryptionKeys(t)
+	store := newTestLocalStore(t)
+
+	content := randomContent(t, 100)
+	first := putEncrypted(t, store, "documents/first", content)
+	second := putEncrypted(t, store, "documents/second", content)
+
+	firstStored, err := os.ReadFile(filepath.Join(store.root, first.FilePath))
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	secondStored, err := os.ReadFile(filepath.Join(store.root, second.FilePath))
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+
+	if bytes.Equal(firstStored[:encryptionHeaderSize], secondStored[:encryptionHeaderSize]) {
+		t.Fatal("both files share the same salt")
+	}
+	if bytes.Equal(firstStored[encryptionHeaderSize:], secondStored[encryptionHeaderSize:]) {
+		t.Fatal("both files share the same ciphertext")
+	}
+}
+
+func TestEncryptionSeek(t *testing.T) {
+	setTestEncryptionKeys(t)
+	store := newTestLocalStore(t)
+
+	content := randomContent(t, encryptionSegmentSize*3+100)
+	file := putEncrypted(t, store, "documents/seek", content)
+
+	reader, err := OpenFile(context.Background(), file)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer reader.Close()
+	seeker := reader.(io.ReadSeeker)
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+		length int
+	}{
+		{offset: encryptionSegmentSize*2 + 10, whence: io.SeekStart, want: encryptionSegmentSize*2 + 10, length: 50},
+		{offset: 10, whence: io.SeekStart, want: 10, length: encryptionSegmentSize + 20},
+		{offset: -30, whence: io.SeekEnd, want: int64(len(content)) - 30, length: 30},
+		{offset: -encryptionSegmentSize * 2, whence: io.SeekCurrent, want: int64(len(content)) - encryptionSegmentSize*2, length: 1},
+		{offset: encryptionSegmentSize - 1, whence: io.SeekStart, want: encryptionSegmentSize - 1, length: 2},
+	}
+	for _, test := range tests {
+		position, err := seeker.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", test.offset, test.whence, err)
+		}
+		if position != test.want {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", test.offset, test.whence, position, test.want)
+		}
+
+		got := make([]byte, test.length)
+		if _, err = io.ReadFull(seeker, got); err != nil {
+			t.Fatalf("reading at %d: %v", position, err)
+		}
+		if !bytes.Equal(got, content[position:position+int64(test.length)]) {
+			t.Fatalf("content at %d differs", position)
+		}
+	}
+
+	if _, err = seeker.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek to the end: %v", err)
+	}
+	if n, err := seeker.Read(make([]byte, 1)); n != 0 || !errors.Is(err, io.EOF) {
+		t.Fatalf("reading at the end returned %d, %v, want EOF", n, err)
+	}
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	setTestEncryptionKeys(t)
+	store := newTestLocalStore(t)
+
+	content := randomContent(t, encryptionSegmentSize*2+100)
+	segment := int64(encryptionSegmentSize + encryptionTagSize)
+
+	tests := []struct {
+		name   string
+		modify func(stored []byte) []byte
+	}{
+		{name: "salt", modify: func(stored []byte) []byte {
+			stored[len(encryptedFileMagic)] ^= 1
+			return stored
+		}},
+		{name: "magic", modify: func(stored []byte) []byte {
+			stored[0] = 'X'
+			return stored
+		}},
+		{name: "second segment", modify: func(stored []byte) []byte {
+			stored[int64(encryptionHeaderSize)+segment+10] ^= 1
+			return stored
+		}},
+		{name: "tag", modify: func(stored []byte) []byte {
+			stored[len(stored)-1] ^= 1
+			return stored
+		}},
+		{name: "swapped segments", modify: func(stored []byte) []byte {
+			first := stored[encryptionHeaderSize : int64(encryptionHeaderSize)+segment]
+			second := stored[int64(encryptionHeaderSize)+segment : int64(encryptionHeaderSize)+segment*2]
+			swapped := append(append([]byte{}, second...), first...)
+			copy(stored[encryptionHeaderSize:], swapped)
+			return stored
+		}},
+		{name: "truncated on a segment boundary", modify: func(stored []byte) []byte {
+			return stored[:int64(encryptionHeaderSize)+segment*2]
+		}},
+		{name: "truncated inside a segment", modify: func(stored []byte) []byte {
+			return stored[:len(stored)-10]
+		}},
+		{name: "truncated header", modify: func(stored []byte) []byte {
+			return stored[:encryptionHeaderSize-1]
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := putEncrypted(t, store, "documents/tampered", content)
+			storedPath := filepath.Join(store.root, file.FilePath)
+
+			stored, err := os.ReadFile(storedPath)
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			if err = os.WriteFile(storedPath, test.modify(stored), 0o600); err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+
+			reader, err := OpenFile(context.Background(), file)
+			if err == nil {
+				_, err = io.ReadAll(reader)
+				reader.Close()
+			}
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Fatalf("reading the tampered file returned %v, want ErrDecryptionFailed", err)
+			}
+		})
+	}
+}
+
+func TestEncryptionReadsLegacyFiles(t *testing.T) {
+	setTestEncryptionKeys(t)
+	store := newTestLocalStore(t)
+
+	// Legacy files are sealed with the key version itself and a random nonce prefix
+	content := randomContent(t, 100)
+	header := append([]byte(legacyEncryptedFileMagic), randomContent(t, encryptionNoncePrefixSize)...)
+	aead, err := encryptionAEAD(1, nil)
+	if err != nil {
+		t.Fatalf("encryptionAEAD: %v", err)
+	}
+	stored := aead.Seal(append([]byte{}, header...), segmentNonce(header[len(legacyEncryptedFileMagic):], 0, true), content, header)
+
+	if err = store.Put(context.Background(), "documents/legacy", bytes.NewReader(stored), int64(len(stored))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	reader, err := OpenFile(context.Background(), File{FilePath: "documents/legacy", Size: uint(len(content)), EncryptionKeyVersion: 1})
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer reader.Close()
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Fatal("decrypted content differs")
+	}
+}
@@ -2,105 +2,429 @@ package files
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
-	"fmt"
-	"io"
+	"errors"
 	"mime"
 	"mime/multipart"
 	"path/filepath"
 	"strings"
 
-	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/rotisserie/eris"
 	"github.com/voxtmault/panacea-shared-lib/storage"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var ErrMediaNotFound = eris.New("media not found")
+
 func SaveToDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string, file *multipart.FileHeader) error {
-	// Get the ORM Connection
-	gConn := storage.GetGORMMariaDB()
-	config := config.GetConfig().FileHandlingConfig
+	return saveUpload(ctx, tx, refId, refTable, file, false)
+}
 
-	var gormTx *gorm.DB
-	gormTx = gConn.WithContext(ctx).Session(&gorm.Session{NewDB: true}).Begin()
+// SaveEncryptedToDB works like SaveToDB but encrypts the stored file, and its variants, with the current media
+// encryption key. Meant for sensitive documents, the file is decrypted transparently when read through OpenFile
+func SaveEncryptedToDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string, file *multipart.FileHeader) error {
+	return saveUpload(ctx, tx, refId, refTable, file, true)
+}
 
-	if tx != nil {
-		// If tx is provided then load the said transaction
-		gormTx = gormTx.Set("gorm:db", tx)
+func saveUpload(ctx context.Context, tx *sql.Tx, refId uint, refTable string, file *multipart.FileHeader, encrypt bool) error {
+	// Stream the file to the designated folder through the configured file store
+	upload, err := storeUpload(ctx, file, encrypt)
+	if err != nil {
+		return err
+	}
+
+	_, err = saveMedia(ctx, tx, refId, refTable, upload)
+	return err
+}
+
+// saveMedia saves the entry of an already stored file to the database alongside its image variants.
+// The stored files are cleaned up if the entry can't be saved
+func saveMedia(ctx context.Context, tx *sql.Tx, refId uint, refTable string, upload storedUpload) (*Media, error) {
+	gormTx := beginGormTx(ctx, tx)
+
+	if err := claimUpload(ctx, gormTx, &upload); err != nil {
+		rollbackGormTx(gormTx, tx)
+		return nil, err
 	}
+	fileInfo := upload.File
+
+	// Generate the configured image variants, they are saved alongside the media entry
+	variants := generateVariants(ctx, fileInfo)
 
 	// Save the file entry to the database
-	fileInfo := File{}
-	var designatedFolder string
+	media := Media{
+		IDMediaType: mediaTypeID(fileInfo.MIMEType),
+		RefID:       refId,
+		SourceTable: refTable,
+		ScanStatus:  upload.ScanStatus,
+		File:        fileInfo,
+		Variants:    variants,
+	}
 
-	fileReader, err := file.Open()
-	if err != nil {
-		if tx == nil {
-			gormTx.Rollback()
+	result := gormTx.Create(&media)
+
+	if result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		discardClaimed(ctx, tx, upload, variants)
+		return nil, result.Error
+	}
+
+	if err := commitGormTx(gormTx, tx); err != nil {
+		discardClaimed(ctx, tx, upload, variants)
+		return nil, err
+	}
+
+	return &media, nil
+}
+
+// GetFromDB returns the media record with the given id alongside its variants, soft deleted records are excluded
+func GetFromDB(ctx context.Context, tx *sql.Tx, id uint) (*Media, error) {
+	var media Media
+
+	result := gormSession(ctx, tx).Preload("Variants").Preload("MediaType").First(&media, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrMediaNotFound
+		}
+		return nil, eris.Wrap(result.Error, "getting media by id")
+	}
+
+	return &media, nil
+}
+
+// GetByRefFromDB returns every media record that belongs to the given reference alongside their variants
+func GetByRefFromDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string) ([]Media, error) {
+	return GetByRefAndTypeFromDB(ctx, tx, refId, refTable)
+}
+
+// GetByRefAndTypeFromDB returns the media records of the given reference whose type is one of the given categories,
+// every category is returned when none is given
+func GetByRefAndTypeFromDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string, categories ...MediaCategory) ([]Media, error) {
+	var media []Media
+
+	query := gormSession(ctx, tx).
+		Preload("Variants").
+		Preload("MediaType").
+		Where("ref_id = ? AND source_table = ?", refId, refTable)
+
+	if len(categories) > 0 {
+		typeIDs := make([]uint, 0, len(categories))
+		for _, category := range categories {
+			typeIDs = append(typeIDs, category.ID())
 		}
+		query = query.Where("id_media_type IN ?", typeIDs)
+	}
+
+	if result := query.Order("id").Find(&media); result.Error != nil {
+		return nil, eris.Wrap(result.Error, "getting media by reference")
+	}
+
+	return media, nil
+}
+
+// GetVariantFromDB returns a specific variant (e.g. thumbnail) of the media record with the given id
+func GetVariantFromDB(ctx context.Context, tx *sql.Tx, mediaId uint, variant string) (*MediaVariant, error) {
+	var mediaVariant MediaVariant
+
+	result := gormSession(ctx, tx).Where("id_media = ? AND variant = ?", mediaId, variant).First(&mediaVariant)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrVariantNotFound
+		}
+		return nil, eris.Wrap(result.Error, "getting media variant")
+	}
+
+	return &mediaVariant, nil
+}
+
+// DeleteFromDB soft deletes the media record with the given id and removes its files from the file store
+// once no other media record references them
+func DeleteFromDB(ctx context.Context, tx *sql.Tx, id uint) error {
+	gormTx := beginGormTx(ctx, tx)
+
+	var media Media
+	if result := gormTx.First(&media, id); result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrMediaNotFound
+		}
+		return eris.Wrap(result.Error, "getting media by id")
+	}
+
+	orphans, err := removeMedia(gormTx, []Media{media})
+	if err != nil {
+		rollbackGormTx(gormTx, tx)
+		return err
+	}
+
+	if err = commitGormTx(gormTx, tx); err != nil {
+		return err
+	}
+
+	_, err = removeOrphanFiles(ctx, tx, orphans)
+	return err
+}
+
+// DeleteByRefFromDB soft deletes every media record that belongs to the given reference and removes their files
+// from the file store once no other media record references them
+func DeleteByRefFromDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string) error {
+	gormTx := beginGormTx(ctx, tx)
+
+	var media []Media
+	result := gormTx.Where("ref_id = ? AND source_table = ?", refId, refTable).Find(&media)
+	if result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		return eris.Wrap(result.Error, "getting media by reference")
+	}
+
+	if len(media) == 0 {
+		rollbackGormTx(gormTx, tx)
+		return nil
+	}
+
+	orphans, err := removeMedia(gormTx, media)
+	if err != nil {
+		rollbackGormTx(gormTx, tx)
 		return err
 	}
 
-	//Calculate the file hash
-	hasher := sha256.New()
-	if _, err = io.Copy(hasher, fileReader); err != nil {
-		if tx == nil {
-			gormTx.Rollback()
+	if err = commitGormTx(gormTx, tx); err != nil {
+		return err
+	}
+
+	_, err = removeOrphanFiles(ctx, tx, orphans)
+	return err
+}
+
+// UpdateInDB replaces the file of the media record with the given id, the previous files are removed from the
+// file store once no other media record references them. The new file is encrypted if the previous one was
+func UpdateInDB(ctx context.Context, tx *sql.Tx, id uint, file *multipart.FileHeader) error {
+	gormTx := beginGormTx(ctx, tx)
+
+	var media Media
+	if result := gormTx.First(&media, id); result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrMediaNotFound
 		}
+		return eris.Wrap(result.Error, "getting media by id")
+	}
+
+	upload, err := storeUpload(ctx, file, media.EncryptionKeyVersion != 0)
+	if err != nil {
+		rollbackGormTx(gormTx, tx)
 		return err
 	}
+	if err = claimUpload(ctx, gormTx, &upload); err != nil {
+		rollbackGormTx(gormTx, tx)
+		return err
+	}
+	fileInfo := upload.File
+	variants := generateVariants(ctx, fileInfo)
 
-	fileInfo.HashValue = hex.EncodeToString(hasher.Sum(nil))
-	designatedFolder, fileInfo.MIMEType = getFileExtension(file.Filename)
+	oldPath := media.FilePath
+	media.File = fileInfo
+	media.IDMediaType = mediaTypeID(fileInfo.MIMEType)
+	media.ScanStatus = upload.ScanStatus
 
-	designatedFolder = fmt.Sprintf("%s/%s/%s", config.FileRootPath, designatedFolder, file.Filename)
+	// The new file might share the same path as the old one, in which case it has already been overwritten
+	upload.Created = upload.Created && oldPath != fileInfo.FilePath
 
-	media := Media{
-		RefID:       refId,
-		SourceTable: refTable,
-		File:        fileInfo,
+	fail := func(err error) error {
+		rollbackGormTx(gormTx, tx)
+		discardClaimed(ctx, tx, upload, variants)
+		return err
 	}
 
-	result := gormTx.Create(&media)
+	if result := gormTx.Select("*").Omit("created_at", "deleted_at", clause.Associations).Updates(&media); result.Error != nil {
+		return fail(eris.Wrap(result.Error, "updating media"))
+	}
 
-	if result.Error != nil {
-		if tx == nil {
-			gormTx.Rollback()
+	variantPaths, err := detachVariants(gormTx, []uint{media.ID})
+	if err != nil {
+		return fail(err)
+	}
+
+	if len(variants) > 0 {
+		for i := range variants {
+			variants[i].IDMedia = media.ID
+		}
+		if result := gormTx.Create(&variants); result.Error != nil {
+			return fail(eris.Wrap(result.Error, "saving media variants"))
 		}
-		return result.Error
 	}
 
-	fileData, err := io.ReadAll(fileReader)
+	orphans, err := orphanedFiles(gormTx, []string{oldPath}, variantPaths)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err = commitGormTx(gormTx, tx); err != nil {
+		discardClaimed(ctx, tx, upload, variants)
+		return err
+	}
+
+	_, err = removeOrphanFiles(ctx, tx, orphans)
+	return err
+}
+
+// UpdateByRefInDB replaces every media record of the given reference with the provided file,
+// the new file is encrypted if any of the previous ones was
+func UpdateByRefInDB(ctx context.Context, tx *sql.Tx, refId uint, refTable string, file *multipart.FileHeader) error {
+	gormTx := beginGormTx(ctx, tx)
+
+	var media []Media
+	result := gormTx.Where("ref_id = ? AND source_table = ?", refId, refTable).Find(&media)
+	if result.Error != nil {
+		rollbackGormTx(gormTx, tx)
+		return eris.Wrap(result.Error, "getting media by reference")
+	}
+
+	encrypt := false
+	for _, item := range media {
+		encrypt = encrypt || item.EncryptionKeyVersion != 0
+	}
+
+	upload, err := storeUpload(ctx, file, encrypt)
 	if err != nil {
-		if tx == nil {
-			gormTx.Rollback()
+		rollbackGormTx(gormTx, tx)
+		return err
+	}
+	if err = claimUpload(ctx, gormTx, &upload); err != nil {
+		rollbackGormTx(gormTx, tx)
+		return err
+	}
+	fileInfo := upload.File
+	variants := generateVariants(ctx, fileInfo)
+
+	// The new file might share the same path as an old one, in which case it has already been overwritten
+	for _, item := range media {
+		if item.FilePath == fileInfo.FilePath {
+			upload.Created = false
 		}
+	}
+
+	fail := func(err error) error {
+		rollbackGormTx(gormTx, tx)
+		discardClaimed(ctx, tx, upload, variants)
 		return err
 	}
 
-	// Save to the designated folder
-	if err = SaveFile(designatedFolder, fileData); err != nil {
+	var variantPaths []string
+	if len(media) > 0 {
+		if result = gormTx.Delete(&media); result.Error != nil {
+			return fail(eris.Wrap(result.Error, "deleting media by reference"))
+		}
+
+		if variantPaths, err = detachVariants(gormTx, mediaIDs(media)); err != nil {
+			return fail(err)
+		}
+	}
+
+	replacement := Media{
+		IDMediaType: mediaTypeID(fileInfo.MIMEType),
+		RefID:       refId,
+		SourceTable: refTable,
+		ScanStatus:  upload.ScanStatus,
+		File:        fileInfo,
+		Variants:    variants,
+	}
+	if result = gormTx.Create(&replacement); result.Error != nil {
+		return fail(eris.Wrap(result.Error, "saving replacement media"))
+	}
+
+	orphans, err := orphanedFiles(gormTx, mediaFilePaths(media), variantPaths)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err = commitGormTx(gormTx, tx); err != nil {
+		discardClaimed(ctx, tx, upload, variants)
 		return err
 	}
 
-	if tx == nil {
-		gormTx.Commit()
+	_, err = removeOrphanFiles(ctx, tx, orphans)
+	return err
+}
+
+// removeMedia soft deletes the given media alongside their variants and returns the files that are no longer referenced,
+// they should be removed from the file store once the transaction is committed
+func removeMedia(gormTx *gorm.DB, media []Media) ([]string, error) {
+	if len(media) == 0 {
+		return nil, nil
 	}
 
-	return nil
+	if result := gormTx.Delete(&media); result.Error != nil {
+		return nil, eris.Wrap(result.Error, "deleting media")
+	}
+
+	variantPaths, err := detachVariants(gormTx, mediaIDs(media))
+	if err != nil {
+		return nil, err
+	}
+
+	return orphanedFiles(gormTx, mediaFilePaths(media), variantPaths)
+}
+
+// mediaFilePaths returns the file path of every given media
+func mediaFilePaths(media []Media) []string {
+	filePaths := make([]string, 0, len(media))
+	for _, item := range media {
+		filePaths = append(filePaths, item.FilePath)
+	}
+
+	return filePaths
+}
+
+// mediaIDs returns the id of every given media
+func mediaIDs(media []Media) []uint {
+	ids := make([]uint, 0, len(media))
+	for _, item := range media {
+		ids = append(ids, item.ID)
+	}
+
+	return ids
 }
 
-func DeleteFromDB() {
+// gormSession returns a gorm session that runs on the provided transaction if any
+func gormSession(ctx context.Context, tx *sql.Tx) *gorm.DB {
+	session := storage.GetGORMMariaDB().WithContext(ctx).Session(&gorm.Session{NewDB: true})
+	if tx != nil {
+		session.Statement.ConnPool = tx
+	}
 
+	return session
 }
 
-func GetFromDB() {
+// beginGormTx loads the provided transaction into gorm, or begins a new one if tx is nil
+func beginGormTx(ctx context.Context, tx *sql.Tx) *gorm.DB {
+	if tx != nil {
+		return gormSession(ctx, tx)
+	}
+
+	return gormSession(ctx, nil).Begin()
+}
 
+// rollbackGormTx rolls back the gorm transaction only if it was started by this package,
+// caller supplied transactions are left for the caller to handle
+func rollbackGormTx(gormTx *gorm.DB, tx *sql.Tx) {
+	if tx == nil {
+		gormTx.Rollback()
+	}
 }
 
-func UpdateInDB() {
+// commitGormTx commits the gorm transaction only if it was started by this package
+func commitGormTx(gormTx *gorm.DB, tx *sql.Tx) error {
+	if tx != nil {
+		return nil
+	}
+
+	if err := gormTx.Commit().Error; err != nil {
+		return eris.Wrap(err, "committing media transaction")
+	}
 
+	return nil
 }
 
 // getFileExtensions returns the designated folder and mime type based on the file extension
@@ -109,21 +433,26 @@ func getFileExtension(filename string) (string, string) {
 	fileExt := filepath.Ext(filename)
 	mimeType := mime.TypeByExtension(fileExt)
 
-	var designatedFolder string
+	return getDesignatedFolder(mimeType), mimeType
+}
+
+// getDesignatedFolder returns the folder, also used as the file category, of the mime type
+func getDesignatedFolder(mimeType string) string {
+	var designatedFolder MediaCategory
 	switch strings.Split(mimeType, "/")[0] {
 	case "image":
-		designatedFolder = "photos"
+		designatedFolder = MediaCategoryPhotos
 	case "application":
-		designatedFolder = "applications" // Including PPTs, PDFs, Docs, etc
+		designatedFolder = MediaCategoryApplications
 	case "video":
-		designatedFolder = "videos"
+		designatedFolder = MediaCategoryVideos
 	case "audio":
-		designatedFolder = "audios"
+		designatedFolder = MediaCategoryAudios
 	case "text":
-		designatedFolder = "plaintexts" // Including .txt and other plain text files
+		designatedFolder = MediaCategoryPlaintexts
 	default:
-		designatedFolder = "others" // This folder is for files that types are not filtered by the switch
+		designatedFolder = MediaCategoryOthers
 	}
 
-	return designatedFolder, mimeType
+	return string(designatedFolder)
 }
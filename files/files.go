@@ -1,7 +1,9 @@
 package files
 
 import (
+	"context"
 	"errors"
+	"io"
 	"os"
 )
 
@@ -26,3 +28,13 @@ func DeleteFile(filePath string) error {
 
 	return nil
 }
+
+// OpenFile opens the stored content of a media or media variant through the configured file store,
+// encrypted files are decrypted while being read. The caller is responsible for closing it
+func OpenFile(ctx context.Context, file File) (io.ReadCloser, error) {
+	if file.EncryptionKeyVersion != 0 {
+		return openEncrypted(ctx, file)
+	}
+
+	return GetFileStore().Get(ctx, file.FilePath)
+}
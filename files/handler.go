@@ -0,0 +1,226 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// FileRangeReader is implemented by file stores that can read part of a file without downloading all of it,
+// it allows the media handler to answer range requests on stores that don't return seekable files
+type FileRangeReader interface {
+	GetRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// MediaHandler serves media files requested through URLs generated by SignMediaURL
+type MediaHandler struct {
+	// ResolveUser returns the id of the user making the request, used to verify URLs bound to a user.
+	// Bound URLs are always rejected when nil
+	ResolveUser func(r *http.Request) string
+}
+
+// NewMediaHandler returns an http.Handler that serves signed media URLs
+func NewMediaHandler(resolveUser func(r *http.Request) string) *MediaHandler {
+	return &MediaHandler{ResolveUser: resolveUser}
+}
+
+func (h *MediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var userID string
+	if h.ResolveUser != nil {
+		userID = h.ResolveUser(r)
+	}
+
+	request, err := VerifyMediaURL(r.URL.Query(), userID)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrURLExpired) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		slog.Error("unable to verify media url", "reason", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	file, modTime, err := h.lookup(r.Context(), request)
+	if err != nil {
+		if errors.Is(err, ErrMediaNotFound) || errors.Is(err, ErrVariantNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("unable to get requested media", "id", request.MediaID, "variant", request.Variant, "reason", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	content, err := openSeekable(r.Context(), *file)
+	if err != nil {
+		if errors.Is(err, ErrFileNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("unable to open requested media", "path", file.FilePath, "reason", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	header := w.Header()
+	if file.MIMEType != "" {
+		header.Set("Content-Type", file.MIMEType)
+	}
+	if file.HashValue != "" {
+		header.Set("ETag", strconv.Quote(file.HashValue))
+	}
+	// Browsers must not guess another type, and only passive content is rendered on our origin
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Disposition", mime.FormatMediaType(contentDisposition(file.MIMEType), map[string]string{"filename": file.Filename}))
+	header.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(time.Until(request.ExpiresAt).Seconds())))
+
+	// ServeContent takes care of range requests and conditional requests based on the ETag
+	http.ServeContent(w, r, file.Filename, modTime, content)
+}
+
+// contentDisposition returns inline for images, videos, audios and PDFs, every other type is downloaded as an
+// attachment so HTML, SVG or XML uploads can't run scripts on the serving origin
+func contentDisposition(mimeType string) string {
+	mimeType = baseMIMEType(strings.ToLower(mimeType))
+
+	switch {
+	case mimeType == "image/svg+xml":
+		return "attachment"
+	case strings.HasPrefix(mimeType, "image/"), strings.HasPrefix(mimeType, "video/"), strings.HasPrefix(mimeType, "audio/"):
+		return "inline"
+	case mimeType == "application/pdf":
+		return "inline"
+	default:
+		return "attachment"
+	}
+}
+
+// lookup returns the file of the requested media or variant
+func (h *MediaHandler) lookup(ctx context.Context, request *SignedMediaRequest) (*File, time.Time, error) {
+	if request.Variant != "" {
+		variant, err := GetVariantFromDB(ctx, nil, request.MediaID, request.Variant)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return &variant.File, variant.UpdatedAt, nil
+	}
+
+	media, err := GetFromDB(ctx, nil, request.MediaID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return &media.File, media.UpdatedAt, nil
+}
+
+// readSeekCloser is what http.ServeContent needs to answer range requests
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// openSeekable opens the file so that it can be seeked, falling back to ranged reads on stores that
+// don't return seekable files
+func openSeekable(ctx context.Context, file File) (readSeekCloser, error) {
+	store := GetFileStore()
+
+	// Encrypted files are opened through OpenFile, which decrypts them as they are seeked
+	if rangeReader, ok := store.(FileRangeReader); ok && file.EncryptionKeyVersion == 0 {
+		info, err := store.Stat(ctx, file.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		return &rangeReadSeeker{ctx: ctx, store: rangeReader, path: file.FilePath, size: info.Size}, nil
+	}
+
+	reader, err := OpenFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if seeker, ok := reader.(readSeekCloser); ok {
+		return seeker, nil
+	}
+
+	reader.Close()
+	return nil, eris.New("file store returned a file that can't be seeked")
+}
+
+// rangeReadSeeker implements io.ReadSeeker on top of ranged reads, the underlying request is only
+// made on the first read after a seek
+type rangeReadSeeker struct {
+	ctx    context.Context
+	store  FileRangeReader
+	path   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *rangeReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		body, err := r.store.GetRange(r.ctx, r.path, r.offset, r.size-r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = r.offset + offset
+	case io.SeekEnd:
+		target = r.size + offset
+	default:
+		return 0, eris.New("invalid whence")
+	}
+
+	if target < 0 {
+		return 0, eris.New("negative position")
+	}
+
+	if target != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = target
+
+	return target, nil
+}
+
+func (r *rangeReadSeeker) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+
+	return nil
+}
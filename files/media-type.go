@@ -0,0 +1,81 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm/clause"
+)
+
+// MediaCategory is the category of a stored file, it doubles as the folder the file is stored in
+type MediaCategory string
+
+const (
+	MediaCategoryPhotos       = MediaCategory("photos")
+	MediaCategoryApplications = MediaCategory("applications") // Including PPTs, PDFs, Docs, etc
+	MediaCategoryVideos       = MediaCategory("videos")
+	MediaCategoryAudios       = MediaCategory("audios")
+	MediaCategoryPlaintexts   = MediaCategory("plaintexts") // Including .txt and other plain text files
+	MediaCategoryOthers       = MediaCategory("others")     // For files that types are not filtered by the other categories
+)
+
+// mediaTypes are the seeded rows of the media type table, their ids are fixed so they can be assigned without a lookup
+var mediaTypes = []MediaType{
+	{ID: 1, Name: MediaCategoryPhotos, Description: "Images such as JPEG, PNG and GIF"},
+	{ID: 2, Name: MediaCategoryApplications, Description: "Documents and binaries such as PDF, Office files and archives"},
+	{ID: 3, Name: MediaCategoryVideos, Description: "Video files"},
+	{ID: 4, Name: MediaCategoryAudios, Description: "Audio files"},
+	{ID: 5, Name: MediaCategoryPlaintexts, Description: "Plain text files"},
+	{ID: 6, Name: MediaCategoryOthers, Description: "Files that don't belong to any other category"},
+}
+
+// fileCategories lists every folder returned by getDesignatedFolder
+var fileCategories = func() []string {
+	categories := make([]string, 0, len(mediaTypes))
+	for _, mediaType := range mediaTypes {
+		categories = append(categories, string(mediaType.Name))
+	}
+	return categories
+}()
+
+// ID returns the id of the seeded media type row of the category, unknown categories fall back to others
+func (c MediaCategory) ID() uint {
+	for _, mediaType := range mediaTypes {
+		if mediaType.Name == c {
+			return mediaType.ID
+		}
+	}
+
+	return MediaCategoryOthers.ID()
+}
+
+// mediaTypeID returns the media type id matching the MIME type
+func mediaTypeID(mimeType string) uint {
+	return MediaCategory(getDesignatedFolder(mimeType)).ID()
+}
+
+// SeedMediaTypes inserts the media type rows that don't exist yet. The media migrations create and seed the table,
+// see NewMigrator, it is only needed when the schema is managed otherwise
+func SeedMediaTypes(ctx context.Context, tx *sql.Tx) error {
+	seeds := make([]MediaType, len(mediaTypes))
+	copy(seeds, mediaTypes)
+
+	result := gormSession(ctx, tx).Clauses(clause.OnConflict{DoNothing: true}).Create(&seeds)
+	if result.Error != nil {
+		return eris.Wrap(result.Error, "seeding media types")
+	}
+
+	return nil
+}
+
+// GetMediaTypesFromDB returns every media type
+func GetMediaTypesFromDB(ctx context.Context, tx *sql.Tx) ([]MediaType, error) {
+	var types []MediaType
+
+	if result := gormSession(ctx, tx).Order("id").Find(&types); result.Error != nil {
+		return nil, eris.Wrap(result.Error, "getting media types")
+	}
+
+	return types, nil
+}
@@ -0,0 +1,27 @@
+package files
+
+import (
+	"database/sql"
+	"embed"
+
+	"github.com/voxtmault/panacea-shared-lib/storage"
+)
+
+// defaultMediaMigrationTable keeps the versions of the media schema apart from the migrations of the service
+const defaultMediaMigrationTable = "media_schema_migrations"
+
+// Migrations holds the schema of the media tables. It assumes the default GORM naming, without table prefix nor
+// singular tables
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
+
+// NewMigrator returns a migrator of the media schema, recording its versions in media_schema_migrations unless
+// opts.Table is set. The MariaDB connection is used when db is nil
+func NewMigrator(db *sql.DB, opts storage.MigrateOptions) (*storage.Migrator, error) {
+	if opts.Table == "" {
+		opts.Table = defaultMediaMigrationTable
+	}
+
+	return storage.NewMigrator(db, Migrations, "migrations", opts)
+}
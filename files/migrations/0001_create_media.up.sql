@@ -0,0 +1,20 @@
+-- The media table as created before the migrations existed, kept as is so existing databases adopt it unchanged
+CREATE TABLE IF NOT EXISTS media (
+    id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    id_media_type BIGINT UNSIGNED NULL,
+    ref_id        BIGINT UNSIGNED NULL,
+    source_table  VARCHAR(191) NULL,
+    created_at    DATETIME(3) NULL,
+    updated_at    DATETIME(3) NULL,
+    deleted_at    DATETIME(3) NULL,
+    filename      LONGTEXT NULL,
+    mime_type     LONGTEXT NULL,
+    size          BIGINT UNSIGNED NULL,
+    file_path     LONGTEXT NULL,
+    hash_value    LONGTEXT NULL,
+    PRIMARY KEY (id),
+    KEY idx_media_id_media_type (id_media_type),
+    KEY idx_media_ref_id (ref_id),
+    KEY idx_media_source_table (source_table),
+    KEY idx_media_deleted_at (deleted_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,4 @@
+-- Live media are back to the zero date of the records written before soft deletion
+UPDATE media SET deleted_at = '0001-01-01 00:00:00' WHERE deleted_at IS NULL;
+
+ALTER TABLE media MODIFY deleted_at DATETIME(3) NOT NULL;
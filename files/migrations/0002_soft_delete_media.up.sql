@@ -0,0 +1,4 @@
+-- Soft deleted media have a deleted_at, live ones used to hold a zero date which is now NULL
+ALTER TABLE media MODIFY deleted_at DATETIME(3) NULL;
+
+UPDATE media SET deleted_at = NULL WHERE deleted_at < '1000-01-01';
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS media_variants (
+    id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    id_media   BIGINT UNSIGNED NULL,
+    variant    VARCHAR(191) NULL,
+    width      BIGINT UNSIGNED NULL,
+    height     BIGINT UNSIGNED NULL,
+    created_at DATETIME(3) NULL,
+    updated_at DATETIME(3) NULL,
+    deleted_at DATETIME(3) NULL,
+    filename   LONGTEXT NULL,
+    mime_type  LONGTEXT NULL,
+    size       BIGINT UNSIGNED NULL,
+    file_path  LONGTEXT NULL,
+    hash_value LONGTEXT NULL,
+    PRIMARY KEY (id),
+    KEY idx_media_variants_id_media (id_media),
+    KEY idx_media_variants_variant (variant),
+    KEY idx_media_variants_deleted_at (deleted_at),
+    CONSTRAINT fk_media_variants FOREIGN KEY (id_media) REFERENCES media (id) ON UPDATE CASCADE ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,3 @@
+ALTER TABLE media DROP FOREIGN KEY IF EXISTS fk_media_media_type;
+
+DROP TABLE IF EXISTS media_types;
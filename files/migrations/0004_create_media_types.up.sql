@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS media_types (
+    id          BIGINT UNSIGNED NOT NULL,
+    name        VARCHAR(32) NULL,
+    description LONGTEXT NULL,
+    created_at  DATETIME(3) NULL,
+    updated_at  DATETIME(3) NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY idx_media_types_name (name)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Same rows as SeedMediaTypes, the media type ids are fixed
+INSERT IGNORE INTO media_types (id, name, description, created_at, updated_at) VALUES
+    (1, 'photos', 'Images such as JPEG, PNG and GIF', NOW(3), NOW(3)),
+    (2, 'applications', 'Documents and binaries such as PDF, Office files and archives', NOW(3), NOW(3)),
+    (3, 'videos', 'Video files', NOW(3), NOW(3)),
+    (4, 'audios', 'Audio files', NOW(3), NOW(3)),
+    (5, 'plaintexts', 'Plain text files', NOW(3), NOW(3)),
+    (6, 'others', 'Files that don''t belong to any other category', NOW(3), NOW(3));
+
+ALTER TABLE media
+    ADD CONSTRAINT fk_media_media_type FOREIGN KEY IF NOT EXISTS (id_media_type)
+        REFERENCES media_types (id) ON UPDATE CASCADE ON DELETE RESTRICT;
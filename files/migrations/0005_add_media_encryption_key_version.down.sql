@@ -0,0 +1,3 @@
+ALTER TABLE media_variants DROP COLUMN IF EXISTS encryption_key_version;
+
+ALTER TABLE media DROP COLUMN IF EXISTS encryption_key_version;
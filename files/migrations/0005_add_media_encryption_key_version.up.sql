@@ -0,0 +1,3 @@
+ALTER TABLE media ADD COLUMN IF NOT EXISTS encryption_key_version BIGINT UNSIGNED NOT NULL DEFAULT 0;
+
+ALTER TABLE media_variants ADD COLUMN IF NOT EXISTS encryption_key_version BIGINT UNSIGNED NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_media_scan_status ON media;
+
+ALTER TABLE media DROP COLUMN IF EXISTS scan_status;
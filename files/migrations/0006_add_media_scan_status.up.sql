@@ -0,0 +1,4 @@
+-- Media stored before scanning existed were never scanned
+ALTER TABLE media ADD COLUMN IF NOT EXISTS scan_status VARCHAR(16) NOT NULL DEFAULT 'skipped';
+
+CREATE INDEX IF NOT EXISTS idx_media_scan_status ON media (scan_status);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_media_variants_file_path ON media_variants;
+
+DROP INDEX IF EXISTS idx_media_file_path ON media;
+
+DROP TABLE IF EXISTS media_file_locks;
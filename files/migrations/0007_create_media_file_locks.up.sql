@@ -0,0 +1,10 @@
+-- Locked by the transactions starting or ending the use of a stored file, see MediaFileLock
+CREATE TABLE IF NOT EXISTS media_file_locks (
+    file_path VARCHAR(512) NOT NULL,
+    PRIMARY KEY (file_path)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- References are looked up and locked by path before a file is removed
+CREATE INDEX IF NOT EXISTS idx_media_file_path ON media (file_path(191));
+
+CREATE INDEX IF NOT EXISTS idx_media_variants_file_path ON media_variants (file_path(191));
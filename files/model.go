@@ -1,6 +1,10 @@
 package files
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type File struct {
 	Filename  string `json:"filename" validate:"required" example:"filename.ext"`
@@ -8,15 +12,50 @@ type File struct {
 	Size      uint   `json:"size" validate:"omitempty,number,gte=0" example:"1024"`
 	FilePath  string `json:"file_path" example:"path/to/your/file"`
 	HashValue string `json:"hash_value" example:"hash_value"`
+
+	// EncryptionKeyVersion is the version of the key that encrypted the stored file, 0 when it is stored in plaintext
+	EncryptionKeyVersion uint `json:"encryption_key_version" gorm:"default:0" example:"0"`
 }
 
 type Media struct {
-	ID          uint      `json:"id" gorm:"primaryKey"`
-	IDMediaType uint      `json:"id_media_type" gorm:"index;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;foreignKey:IDMediaType;references:ID"`
-	RefID       uint      `json:"ref_id" gorm:"index"`
-	SourceTable string    `json:"source_table" gorm:"index"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	DeletedAt   time.Time `json:"deleted_at" gorm:"index"`
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	IDMediaType uint           `json:"id_media_type" gorm:"index"`
+	MediaType   *MediaType     `json:"media_type,omitempty" gorm:"foreignKey:IDMediaType;references:ID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT"`
+	RefID       uint           `json:"ref_id" gorm:"index"`
+	SourceTable string         `json:"source_table" gorm:"index"`
+	ScanStatus  ScanStatus     `json:"scan_status" gorm:"type:varchar(16);index;default:skipped" example:"clean"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"index"`
+	File
+	Variants []MediaVariant `json:"variants,omitempty" gorm:"foreignKey:IDMedia"`
+}
+
+// MediaVariant is a resized copy of a photo, linked to its original Media record
+type MediaVariant struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	IDMedia   uint           `json:"id_media" gorm:"index;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Variant   string         `json:"variant" gorm:"index" example:"thumbnail"`
+	Width     uint           `json:"width" example:"200"`
+	Height    uint           `json:"height" example:"150"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"deleted_at" gorm:"index"`
 	File
 }
+
+// MediaFileLock is locked by the transactions starting or ending the use of a stored file, so a file shared through
+// content addressing or hash naming isn't removed while another upload starts reusing it. A row exists while its
+// file does
+type MediaFileLock struct {
+	FilePath string `gorm:"primaryKey;type:varchar(512)"`
+}
+
+// MediaType classifies a Media record, its rows are seeded from the MediaCategory list by SeedMediaTypes
+type MediaType struct {
+	ID          uint          `json:"id" gorm:"primaryKey;autoIncrement:false"`
+	Name        MediaCategory `json:"name" gorm:"type:varchar(32);uniqueIndex" example:"photos"`
+	Description string        `json:"description" example:"Images such as JPEG, PNG and GIF"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
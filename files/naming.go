@@ -0,0 +1,115 @@
+package files
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/rotisserie/eris"
+)
+
+var ErrInvalidPath = eris.New("invalid file path")
+
+const (
+	// NamingStrategyUUID stores every upload under a random UUID, this is the default
+	NamingStrategyUUID = "uuid"
+
+	// NamingStrategyHash stores every upload under its sha256 hash, identical uploads in the same
+	// category share the same file
+	NamingStrategyHash = "hash"
+)
+
+// maxExtensionLength limits how much of the client supplied extension is kept on the stored name
+const maxExtensionLength = 10
+
+// cleanStorePath validates a slash separated path relative to the store root. Absolute paths and
+// paths escaping the root through ".." are rejected instead of being silently rewritten
+func cleanStorePath(filePath string) (string, error) {
+	filePath = strings.ReplaceAll(filePath, "\\", "/")
+	if filePath == "" || strings.ContainsRune(filePath, 0) || strings.HasPrefix(filePath, "/") {
+		return "", ErrInvalidPath
+	}
+
+	for _, segment := range strings.Split(filePath, "/") {
+		if segment == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+
+	cleaned := path.Clean(filePath)
+	if cleaned == "." {
+		return "", ErrInvalidPath
+	}
+
+	return cleaned, nil
+}
+
+// sanitizeFilename returns the base name of the client supplied filename with control characters removed,
+// it is only kept as metadata and never used to build a path
+func sanitizeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+
+	if filename == "" || filename == "." || filename == ".." || filename == "/" {
+		return "file"
+	}
+
+	return filename
+}
+
+// sanitizeExtension returns the lower cased extension of the filename restricted to alphanumeric characters
+func sanitizeExtension(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(sanitizeFilename(filename)), "."))
+	ext = strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return -1
+	}, ext)
+
+	if ext == "" {
+		return ""
+	}
+	if len(ext) > maxExtensionLength {
+		ext = ext[:maxExtensionLength]
+	}
+
+	return "." + ext
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", eris.Wrap(err, "generating uuid")
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant RFC 4122
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// uuidFilePath returns a random path inside the designated folder
+func uuidFilePath(designatedFolder, filename string) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(designatedFolder, id+sanitizeExtension(filename)), nil
+}
+
+// hashFilePath returns the path inside the designated folder derived from the file hash
+func hashFilePath(designatedFolder, filename, hashValue string) string {
+	return path.Join(designatedFolder, hashValue+sanitizeExtension(filename))
+}
@@ -0,0 +1,74 @@
+package files
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCleanStorePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		invalid bool
+	}{
+		{path: "photos/a.png", want: "photos/a.png"},
+		{path: "photos/2024/a.png", want: "photos/2024/a.png"},
+		{path: "photos//a.png", want: "photos/a.png"},
+		{path: "photos/./a.png", want: "photos/a.png"},
+		{path: "photos/a.png/", want: "photos/a.png"},
+		{path: `photos\a.png`, want: "photos/a.png"},
+		{path: "photos/..a.png", want: "photos/..a.png"},
+		{path: "photos/a..png", want: "photos/a..png"},
+
+		{path: "", invalid: true},
+		{path: ".", invalid: true},
+		{path: "./", invalid: true},
+		{path: "..", invalid: true},
+		{path: "../etc/passwd", invalid: true},
+		{path: "photos/../../etc/passwd", invalid: true},
+		{path: "photos/../a.png", invalid: true},
+		{path: "photos/..", invalid: true},
+		{path: `photos\..\..\etc\passwd`, invalid: true},
+		{path: "/etc/passwd", invalid: true},
+		{path: `\etc\passwd`, invalid: true},
+		{path: "//server/share", invalid: true},
+		{path: "photos/a.png\x00.jpg", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := cleanStorePath(test.path)
+		if test.invalid {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("cleanStorePath(%q) = %q, %v, want ErrInvalidPath", test.path, got, err)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("cleanStorePath(%q) = %q, %v, want %q", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{filename: "report.pdf", want: "report.pdf"},
+		{filename: "../../etc/passwd", want: "passwd"},
+		{filename: `C:\Users\me\report.pdf`, want: "report.pdf"},
+		{filename: "re\x00po\nrt.pdf", want: "report.pdf"},
+		{filename: "  spaced.txt  ", want: "spaced.txt"},
+		{filename: "", want: "file"},
+		{filename: "..", want: "file"},
+		{filename: "dir/", want: "dir"},
+		{filename: "/", want: "file"},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeFilename(test.filename); got != test.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", test.filename, got, test.want)
+		}
+	}
+}
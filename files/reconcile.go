@@ -0,0 +1,226 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"gorm.io/gorm"
+)
+
+const reconcileBatchSize = 500
+
+// ReconcileOptions customizes a Reconcile run
+type ReconcileOptions struct {
+	// Repair removes orphan files and soft deletes records whose file is missing, nothing is changed when false
+	Repair bool
+
+	// VerifyHashes reads every referenced file to compare it against its HashValue, this can be slow on large stores
+	VerifyHashes bool
+
+	// GracePeriod skips files modified recently as they may belong to a save still in progress, default to 1 hour
+	GracePeriod time.Duration
+}
+
+// MissingFile is a record whose file doesn't exist in the file store
+type MissingFile struct {
+	MediaID   uint   `json:"media_id"`
+	VariantID uint   `json:"variant_id,omitempty"`
+	FilePath  string `json:"file_path"`
+}
+
+// HashMismatch is a record whose file content doesn't match its HashValue
+type HashMismatch struct {
+	MediaID   uint   `json:"media_id"`
+	VariantID uint   `json:"variant_id,omitempty"`
+	FilePath  string `json:"file_path"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+// ReconcileReport summarizes the differences between the file store and the media tables
+type ReconcileReport struct {
+	DryRun         bool           `json:"dry_run"`
+	ScannedFiles   int            `json:"scanned_files"`
+	ScannedRecords int            `json:"scanned_records"`
+	OrphanFiles    []ObjectInfo   `json:"orphan_files"`
+	MissingFiles   []MissingFile  `json:"missing_files"`
+	HashMismatches []HashMismatch `json:"hash_mismatches"`
+	RemovedFiles   int            `json:"removed_files"`
+	RemovedRecords int            `json:"removed_records"`
+	Errors         []string       `json:"errors"`
+}
+
+// reconcileRecord is a file referenced by either a media or a media variant
+type reconcileRecord struct {
+	mediaID   uint
+	variantID uint
+	file      File
+}
+
+// Reconcile walks the file store and the media tables to find files without a record, records without a file and,
+// optionally, files whose content doesn't match their hash. Problems are only reported unless Repair is set
+func Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = time.Hour
+	}
+
+	report := &ReconcileReport{DryRun: !opts.Repair}
+	store := GetFileStore()
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return nil, eris.Wrap(err, "listing stored files")
+	}
+
+	stored := make(map[string]ObjectInfo, len(objects))
+	for _, object := range objects {
+		stored[object.Path] = object
+	}
+	report.ScannedFiles = len(objects)
+
+	referenced := make(map[string]bool)
+	var missing []reconcileRecord
+
+	check := func(record reconcileRecord) {
+		report.ScannedRecords++
+		referenced[record.file.FilePath] = true
+
+		if _, exists := stored[record.file.FilePath]; !exists {
+			missing = append(missing, record)
+			report.MissingFiles = append(report.MissingFiles, MissingFile{
+				MediaID:   record.mediaID,
+				VariantID: record.variantID,
+				FilePath:  record.file.FilePath,
+			})
+			return
+		}
+
+		if opts.VerifyHashes && record.file.HashValue != "" {
+			actual, err := hashStoredFile(ctx, record.file)
+			if err != nil {
+				report.Errors = append(report.Errors, eris.Wrapf(err, "hashing %s", record.file.FilePath).Error())
+				return
+			}
+			if actual != record.file.HashValue {
+				report.HashMismatches = append(report.HashMismatches, HashMismatch{
+					MediaID:   record.mediaID,
+					VariantID: record.variantID,
+					FilePath:  record.file.FilePath,
+					Expected:  record.file.HashValue,
+					Actual:    actual,
+				})
+			}
+		}
+	}
+
+	var mediaBatch []Media
+	result := gormSession(ctx, nil).FindInBatches(&mediaBatch, reconcileBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, media := range mediaBatch {
+			check(reconcileRecord{mediaID: media.ID, file: media.File})
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return nil, eris.Wrap(result.Error, "scanning media")
+	}
+
+	var variantBatch []MediaVariant
+	result = gormSession(ctx, nil).FindInBatches(&variantBatch, reconcileBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, variant := range variantBatch {
+			check(reconcileRecord{mediaID: variant.IDMedia, variantID: variant.ID, file: variant.File})
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return nil, eris.Wrap(result.Error, "scanning media variants")
+	}
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, object := range objects {
+		if referenced[object.Path] || isUnreferencedPath(object.Path) || object.ModTime.After(cutoff) {
+			continue
+		}
+		report.OrphanFiles = append(report.OrphanFiles, object)
+	}
+
+	if opts.Repair {
+		repairOrphans(ctx, report)
+		repairMissing(ctx, report, missing)
+	}
+
+	slog.Info("media reconciliation finished",
+		"dry_run", report.DryRun,
+		"orphan_files", len(report.OrphanFiles),
+		"missing_files", len(report.MissingFiles),
+		"hash_mismatches", len(report.HashMismatches),
+	)
+
+	return report, nil
+}
+
+// isUnreferencedPath reports whether the path belongs to an upload still being processed or to a quarantined file,
+// neither is ever referenced by a record and both are handled by their own routines
+func isUnreferencedPath(filePath string) bool {
+	for _, folder := range []string{tempUploadFolder, uploadSessionFolder, quarantineFolder} {
+		if strings.HasPrefix(filePath, folder+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hashStoredFile returns the hex encoded sha256 of a stored file
+func hashStoredFile(ctx context.Context, file File) (string, error) {
+	reader, err := OpenFile(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// repairOrphans removes the files that no record references, each one is checked again under its lock since an upload
+// may have claimed it after the scan
+func repairOrphans(ctx context.Context, report *ReconcileReport) {
+	for _, object := range report.OrphanFiles {
+		removed, err := removeOrphanFiles(ctx, nil, []string{object.Path})
+		if err != nil {
+			report.Errors = append(report.Errors, eris.Wrapf(err, "removing %s", object.Path).Error())
+			continue
+		}
+		report.RemovedFiles += removed
+	}
+}
+
+// repairMissing soft deletes the records whose file is missing. A media whose original file is missing is removed
+// together with its variants, while a missing variant only removes that variant
+func repairMissing(ctx context.Context, report *ReconcileReport, missing []reconcileRecord) {
+	for _, record := range missing {
+		var err error
+		if record.variantID != 0 {
+			err = gormSession(ctx, nil).Delete(&MediaVariant{}, record.variantID).Error
+		} else {
+			err = DeleteFromDB(ctx, nil, record.mediaID)
+		}
+
+		if err != nil && !errors.Is(err, ErrMediaNotFound) {
+			report.Errors = append(report.Errors, eris.Wrapf(err, "removing record of %s", record.file.FilePath).Error())
+			continue
+		}
+		report.RemovedRecords++
+	}
+}
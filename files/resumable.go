@@ -0,0 +1,450 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/voxtmault/panacea-shared-lib/storage"
+)
+
+const (
+	// uploadSessionFolder holds the chunks of resumable uploads until they are finalized
+	uploadSessionFolder = "uploads"
+
+	uploadSessionKeyPrefix = "upload_session:"
+	uploadLockKeyPrefix    = "upload_session_lock:"
+
+	// uploadLockExpiration bounds how long a crashed request can hold a session, the lock is refreshed every
+	// uploadLockRefreshInterval while the request runs
+	uploadLockExpiration      = time.Minute
+	uploadLockRefreshInterval = uploadLockExpiration / 3
+
+	// defaultUploadSessionExpiration is used when UploadSessionExpiration is 0, which would keep sessions forever
+	defaultUploadSessionExpiration = time.Hour * 24
+)
+
+// unlockUploadSessionScript releases the lock only when it is still held by the given token, a request outliving
+// uploadLockExpiration must not release the lock another request acquired since
+var unlockUploadSessionScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// refreshUploadSessionScript extends the lock only when it is still held by the given token
+var refreshUploadSessionScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var (
+	ErrUploadSessionNotFound = eris.New("upload session not found or expired")
+	ErrUploadSessionBusy     = eris.New("upload session is busy with another chunk")
+	ErrUploadIncomplete      = eris.New("upload session has not received every chunk")
+	ErrUploadComplete        = eris.New("upload session has already received every chunk")
+)
+
+// OffsetMismatchError is returned when a chunk doesn't start where the previous one ended,
+// the client should resume from Expected
+type OffsetMismatchError struct {
+	Expected int64 `json:"expected"`
+	Received int64 `json:"received"`
+}
+
+func (e *OffsetMismatchError) Error() string {
+	return fmt.Sprintf("chunk offset %d does not match the expected offset %d", e.Received, e.Expected)
+}
+
+// UploadPart is a chunk stored for an upload session
+type UploadPart struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Path   string `json:"path"`
+}
+
+// UploadSession tracks the progress of a resumable upload
+type UploadSession struct {
+	ID          string       `json:"id"`
+	RefID       uint         `json:"ref_id"`
+	SourceTable string       `json:"source_table"`
+	Filename    string       `json:"filename"`
+	Size        int64        `json:"size"`
+	Received    int64        `json:"received"`
+	Parts       []UploadPart `json:"parts"`
+	CreatedAt   time.Time    `json:"created_at"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+}
+
+// Progress returns the ratio of received bytes, between 0 and 1
+func (s *UploadSession) Progress() float64 {
+	if s.Size <= 0 {
+		return 0
+	}
+
+	return float64(s.Received) / float64(s.Size)
+}
+
+// Complete reports whether every byte of the file has been received
+func (s *UploadSession) Complete() bool {
+	return s.Received == s.Size
+}
+
+// CreateUploadSession starts a resumable upload of a file with the given name and total size,
+// the file will be attached to the given reference once finalized
+func CreateUploadSession(ctx context.Context, refId uint, refTable, filename string, size int64) (*UploadSession, error) {
+	if size <= 0 {
+		return nil, eris.New("upload size must be greater than zero")
+	}
+
+	// Reject early based on the declared type, the content is validated again when the upload is finalized
+	designatedFolder, declared := getFileExtension(filename)
+	if limit := categoryMaxUploadSize(designatedFolder); limit > 0 && size > limit {
+		return nil, &ValidationError{
+			Kind:         ValidationErrorKindTooLarge,
+			Filename:     sanitizeFilename(filename),
+			Category:     designatedFolder,
+			DeclaredType: declared,
+		}
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:          id,
+		RefID:       refId,
+		SourceTable: refTable,
+		Filename:    sanitizeFilename(filename),
+		Size:        size,
+		Parts:       []UploadPart{},
+		CreatedAt:   now,
+	}
+
+	if err = saveUploadSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetUploadSession returns the current state of an upload session, used by clients to resume an upload
+func GetUploadSession(ctx context.Context, sessionID string) (*UploadSession, error) {
+	data, err := storage.GetRedisCon().Get(ctx, uploadSessionKeyPrefix+sessionID).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, eris.Wrap(err, "getting upload session")
+	}
+
+	var session UploadSession
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, eris.Wrap(err, "decoding upload session")
+	}
+
+	return &session, nil
+}
+
+// UploadChunk appends a chunk to the upload session. Offset must be equal to the amount of bytes already received,
+// otherwise an OffsetMismatchError holding the expected offset is returned
+func UploadChunk(ctx context.Context, sessionID string, offset int64, chunk io.Reader) (*UploadSession, error) {
+	ctx, unlock, err := lockUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	session, err := GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing can be appended once the declared size is reached, Complete would never be true again
+	if offset >= session.Size {
+		return session, ErrUploadComplete
+	}
+	if offset != session.Received {
+		return session, &OffsetMismatchError{Expected: session.Received, Received: offset}
+	}
+
+	part := UploadPart{
+		Offset: offset,
+		Path:   path.Join(uploadSessionFolder, session.ID, fmt.Sprintf("%020d", offset)),
+	}
+
+	// Chunks can't go past the declared size
+	reader := newUploadReader(chunk, session.Size-offset)
+	if err = GetFileStore().Put(ctx, part.Path, reader, -1); err != nil {
+		discardUpload(ctx, part.Path)
+		if errors.Is(err, ErrFileTooLarge) {
+			return session, eris.New("chunk exceeds the declared upload size")
+		}
+		return session, eris.Wrap(err, "storing upload chunk")
+	}
+
+	if reader.size == 0 {
+		discardUpload(ctx, part.Path)
+		return session, nil
+	}
+
+	part.Size = reader.size
+	session.Parts = append(session.Parts, part)
+	session.Received += part.Size
+
+	if err = saveUploadSession(ctx, session); err != nil {
+		discardUpload(ctx, part.Path)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// FinalizeUpload assembles the chunks of a complete upload session into a regular media record, going through the same
+// validation, naming and variant generation as SaveToDB. The session and its chunks are removed afterward
+func FinalizeUpload(ctx context.Context, tx *sql.Tx, sessionID string) (*Media, error) {
+	ctx, unlock, err := lockUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	session, err := GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !session.Complete() {
+		return nil, ErrUploadIncomplete
+	}
+
+	parts := &partsReader{ctx: ctx, parts: session.Parts}
+	upload, err := storeStream(ctx, session.Filename, parts, session.Size, false)
+	parts.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := saveMedia(ctx, tx, session.RefID, session.SourceTable, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = removeUploadSession(ctx, session); err != nil {
+		slog.Warn("unable to clean up finalized upload session", "id", session.ID, "reason", err)
+	}
+
+	return media, nil
+}
+
+// AbortUpload cancels an upload session and removes the chunks received so far
+func AbortUpload(ctx context.Context, sessionID string) error {
+	ctx, unlock, err := lockUploadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	session, err := GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return removeUploadSession(ctx, session)
+}
+
+// CleanupExpiredUploads removes the chunks of upload sessions that expired before being finalized,
+// meant to be run periodically. Returns the amount of sessions cleaned up
+func CleanupExpiredUploads(ctx context.Context) (int, error) {
+	objects, err := GetFileStore().List(ctx, uploadSessionFolder+"/")
+	if err != nil {
+		return 0, eris.Wrap(err, "listing upload chunks")
+	}
+
+	chunks := make(map[string][]string)
+	for _, object := range objects {
+		sessionID, _, found := strings.Cut(strings.TrimPrefix(object.Path, uploadSessionFolder+"/"), "/")
+		if !found {
+			continue
+		}
+		chunks[sessionID] = append(chunks[sessionID], object.Path)
+	}
+
+	con := storage.GetRedisCon()
+	cleaned := 0
+	for sessionID, paths := range chunks {
+		exists, err := con.Exists(ctx, uploadSessionKeyPrefix+sessionID).Result()
+		if err != nil {
+			return cleaned, eris.Wrap(err, "checking upload session")
+		}
+		if exists > 0 {
+			continue
+		}
+
+		if err = removeFiles(ctx, paths); err != nil {
+			return cleaned, err
+		}
+		cleaned++
+	}
+
+	return cleaned, nil
+}
+
+// saveUploadSession persists the session and extends its expiry
+func saveUploadSession(ctx context.Context, session *UploadSession) error {
+	expiration := time.Minute * time.Duration(config.GetConfig().FileHandlingConfig.UploadSessionExpiration)
+	if expiration <= 0 {
+		expiration = defaultUploadSessionExpiration
+	}
+	session.ExpiresAt = time.Now().Add(expiration)
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return eris.Wrap(err, "encoding upload session")
+	}
+
+	if err = storage.GetRedisCon().Set(ctx, uploadSessionKeyPrefix+session.ID, data, expiration).Err(); err != nil {
+		return eris.Wrap(err, "saving upload session")
+	}
+
+	return nil
+}
+
+// removeUploadSession deletes the session and its chunks
+func removeUploadSession(ctx context.Context, session *UploadSession) error {
+	if err := storage.GetRedisCon().Del(ctx, uploadSessionKeyPrefix+session.ID).Err(); err != nil {
+		return eris.Wrap(err, "deleting upload session")
+	}
+
+	paths := make([]string, 0, len(session.Parts))
+	for _, part := range session.Parts {
+		paths = append(paths, part.Path)
+	}
+
+	return removeFiles(ctx, paths)
+}
+
+// lockUploadSession prevents chunks of the same session from being processed concurrently. The lock is refreshed
+// until unlock is called, the returned context is cancelled if the lock is lost meanwhile so the request stops
+// before another one takes over the session
+func lockUploadSession(ctx context.Context, sessionID string) (context.Context, func(), error) {
+	con := storage.GetRedisCon()
+	key := uploadLockKeyPrefix + sessionID
+
+	token, err := newUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acquired, err := con.SetNX(ctx, key, token, uploadLockExpiration).Result()
+	if err != nil {
+		return nil, nil, eris.Wrap(err, "locking upload session")
+	}
+	if !acquired {
+		return nil, nil, ErrUploadSessionBusy
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+
+		ticker := time.NewTicker(uploadLockRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			held, err := refreshUploadSessionScript.Run(lockCtx, con, []string{key}, token, uploadLockExpiration.Milliseconds()).Int()
+			if err != nil {
+				// The next refresh still happens before the lock expires
+				if lockCtx.Err() == nil {
+					slog.Warn("unable to refresh upload session lock", "id", sessionID, "reason", err)
+				}
+				continue
+			}
+			if held == 0 {
+				slog.Error("upload session lock lost, cancelling the request", "id", sessionID)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return lockCtx, func() {
+		cancel()
+		<-refreshed
+
+		// The request context may already be cancelled at this point
+		released, err := unlockUploadSessionScript.Run(context.Background(), con, []string{key}, token).Int()
+		if err != nil {
+			slog.Warn("unable to unlock upload session", "id", sessionID, "reason", err)
+		} else if released == 0 {
+			slog.Warn("upload session lock expired before being released", "id", sessionID)
+		}
+	}, nil
+}
+
+// partsReader reads the chunks of an upload session one after the other
+type partsReader struct {
+	ctx     context.Context
+	parts   []UploadPart
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			reader, err := GetFileStore().Get(r.ctx, r.parts[0].Path)
+			if err != nil {
+				return 0, eris.Wrap(err, "opening upload chunk")
+			}
+			r.current = reader
+			r.parts = r.parts[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+
+	return nil
+}
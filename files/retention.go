@@ -0,0 +1,234 @@
+package files
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const defaultPurgeBatchSize = 100
+
+// RetentionRule describes how long the media of a source table are kept
+type RetentionRule struct {
+	// SourceTable the rule applies to, matched against Media.SourceTable
+	SourceTable string
+
+	// PurgeDeletedAfter hard deletes soft deleted media once they have been deleted for this long, 0 disables purging
+	PurgeDeletedAfter time.Duration
+
+	// MaxFilesPerRef keeps only the newest media of every reference, older ones are soft deleted. 0 disables the cap
+	MaxFilesPerRef uint
+}
+
+// PurgeOptions customizes a PurgeMedia run
+type PurgeOptions struct {
+	// BatchSize is the amount of records removed per transaction, default to 100
+	BatchSize int
+}
+
+// PurgeResult is what a single retention rule removed
+type PurgeResult struct {
+	SourceTable    string   `json:"source_table"`
+	PurgedRecords  int      `json:"purged_records"`
+	CappedRecords  int      `json:"capped_records"`
+	RemovedFiles   int      `json:"removed_files"`
+	Errors         []string `json:"errors"`
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+}
+
+// PurgeMedia applies every retention rule and reports what has been removed. A failing rule doesn't stop the others,
+// its error is recorded in its result instead
+func PurgeMedia(ctx context.Context, rules []RetentionRule, opts PurgeOptions) []PurgeResult {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultPurgeBatchSize
+	}
+
+	results := make([]PurgeResult, 0, len(rules))
+	for _, rule := range rules {
+		start := time.Now()
+		result := PurgeResult{SourceTable: rule.SourceTable}
+
+		if rule.MaxFilesPerRef > 0 {
+			if err := capMediaPerRef(ctx, rule, &result); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+
+		// Runs after the cap so the media it soft deleted are purged once they are old enough
+		if rule.PurgeDeletedAfter > 0 {
+			if err := purgeDeletedMedia(ctx, rule, opts.BatchSize, &result); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+
+		result.ElapsedSeconds = time.Since(start).Seconds()
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// StartPurgeScheduler runs PurgeMedia every interval until the context is cancelled, the results are logged.
+// An error is returned when the interval isn't positive
+func StartPurgeScheduler(ctx context.Context, interval time.Duration, rules []RetentionRule, opts PurgeOptions) error {
+	if interval <= 0 {
+		return eris.Errorf("invalid media purge interval %s", interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Debug("media purge scheduler stopped")
+				return
+			case <-ticker.C:
+				for _, result := range PurgeMedia(ctx, rules, opts) {
+					if len(result.Errors) > 0 {
+						slog.Error("media purge finished with errors", "source_table", result.SourceTable, "errors", result.Errors)
+					}
+					slog.Info("media purge finished",
+						"source_table", result.SourceTable,
+						"purged_records", result.PurgedRecords,
+						"capped_records", result.CappedRecords,
+						"removed_files", result.RemovedFiles,
+					)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// purgeDeletedMedia hard deletes the soft deleted media of the rule, and their variants, in batches
+func purgeDeletedMedia(ctx context.Context, rule RetentionRule, batchSize int, result *PurgeResult) error {
+	cutoff := time.Now().Add(-rule.PurgeDeletedAfter)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var batch []Media
+		query := gormSession(ctx, nil).Unscoped().
+			Where("source_table = ? AND deleted_at IS NOT NULL AND deleted_at < ?", rule.SourceTable, cutoff).
+			Order("id").
+			Limit(batchSize).
+			Find(&batch)
+		if query.Error != nil {
+			return eris.Wrap(query.Error, "getting deleted media")
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		removed, err := hardDeleteMedia(ctx, batch)
+		if err != nil {
+			return err
+		}
+		result.PurgedRecords += len(batch)
+		result.RemovedFiles += removed
+
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
+
+// hardDeleteMedia permanently removes the media and their variants, then removes the files nothing references anymore.
+// Returns the amount of removed files
+func hardDeleteMedia(ctx context.Context, media []Media) (int, error) {
+	gormTx := beginGormTx(ctx, nil)
+	ids := mediaIDs(media)
+
+	var variantPaths []string
+	result := gormTx.Unscoped().Model(&MediaVariant{}).Where("id_media IN ?", ids).Pluck("file_path", &variantPaths)
+	if result.Error != nil {
+		gormTx.Rollback()
+		return 0, eris.Wrap(result.Error, "getting media variants")
+	}
+
+	if result = gormTx.Unscoped().Where("id_media IN ?", ids).Delete(&MediaVariant{}); result.Error != nil {
+		gormTx.Rollback()
+		return 0, eris.Wrap(result.Error, "purging media variants")
+	}
+
+	if result = gormTx.Unscoped().Delete(&media); result.Error != nil {
+		gormTx.Rollback()
+		return 0, eris.Wrap(result.Error, "purging media")
+	}
+
+	// Files are usually removed when the media is soft deleted, this catches the ones left behind
+	orphans, err := orphanedFiles(gormTx, mediaFilePaths(media), variantPaths)
+	if err != nil {
+		gormTx.Rollback()
+		return 0, err
+	}
+
+	if err = commitGormTx(gormTx, nil); err != nil {
+		return 0, err
+	}
+
+	return removeOrphanFiles(ctx, nil, orphans)
+}
+
+// capMediaPerRef soft deletes the oldest media of every reference holding more than MaxFilesPerRef media
+func capMediaPerRef(ctx context.Context, rule RetentionRule, result *PurgeResult) error {
+	var refIDs []uint
+	query := gormSession(ctx, nil).Model(&Media{}).
+		Where("source_table = ?", rule.SourceTable).
+		Group("ref_id").
+		Having("COUNT(*) > ?", rule.MaxFilesPerRef).
+		Pluck("ref_id", &refIDs)
+	if query.Error != nil {
+		return eris.Wrap(query.Error, "getting references over the cap")
+	}
+
+	for _, refID := range refIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// MariaDB doesn't accept an OFFSET without a LIMIT, so the newest media are skipped here instead
+		var media []Media
+		query = gormSession(ctx, nil).
+			Where("ref_id = ? AND source_table = ?", refID, rule.SourceTable).
+			Order("created_at DESC, id DESC").
+			Find(&media)
+		if query.Error != nil {
+			return eris.Wrap(query.Error, "getting media over the cap")
+		}
+
+		if uint(len(media)) <= rule.MaxFilesPerRef {
+			continue
+		}
+		excess := media[rule.MaxFilesPerRef:]
+
+		gormTx := beginGormTx(ctx, nil)
+		orphans, err := removeMedia(gormTx, excess)
+		if err != nil {
+			gormTx.Rollback()
+			return err
+		}
+
+		if err = commitGormTx(gormTx, nil); err != nil {
+			return err
+		}
+
+		removed, err := removeOrphanFiles(ctx, nil, orphans)
+		if err != nil {
+			return err
+		}
+
+		result.CappedRecords += len(excess)
+		result.RemovedFiles += removed
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+// clamAVChunkSize is the size of the chunks streamed to clamd, it must stay below its StreamMaxLength
+const clamAVChunkSize = 64 * 1024
+
+// ClamAVScanner scans files through a clamd daemon using its INSTREAM command
+type ClamAVScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamAVScanner returns a scanner connecting to the clamd daemon described by the ClamAV config
+func NewClamAVScanner(cfg *config.FileHandlingConfig) (*ClamAVScanner, error) {
+	if cfg.ClamAVAddress == "" {
+		return nil, eris.New("clamav address is empty")
+	}
+
+	network := strings.ToLower(strings.TrimSpace(cfg.ClamAVNetwork))
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "unix":
+	default:
+		return nil, eris.Errorf("unsupported clamav network %q", cfg.ClamAVNetwork)
+	}
+
+	timeout := time.Second * time.Duration(cfg.ClamAVTimeout)
+	if timeout <= 0 {
+		timeout = time.Second * 30
+	}
+
+	return &ClamAVScanner{
+		network: network,
+		address: cfg.ClamAVAddress,
+		timeout: timeout,
+	}, nil
+}
+
+// Scan streams r to clamd and parses its verdict
+func (s *ClamAVScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriterSize(conn, clamAVChunkSize+4)
+	if _, err = writer.WriteString("zINSTREAM\x00"); err != nil {
+		return nil, eris.Wrap(err, "sending clamav command")
+	}
+
+	chunk := make([]byte, clamAVChunkSize)
+	length := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			writer.Write(length)
+			if _, werr := writer.Write(chunk[:n]); werr != nil {
+				// clamd closes the connection when the stream exceeds its limit, its reply explains why
+				return s.reply(conn)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, eris.Wrap(err, "reading file to scan")
+		}
+	}
+
+	// A zero length chunk ends the stream
+	binary.BigEndian.PutUint32(length, 0)
+	writer.Write(length)
+	if err = writer.Flush(); err != nil {
+		return nil, eris.Wrap(err, "streaming file to clamav")
+	}
+
+	return s.reply(conn)
+}
+
+// Ping checks that clamd is reachable and answering
+func (s *ClamAVScanner) Ping(ctx context.Context) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("zPING\x00")); err != nil {
+		return eris.Wrap(err, "sending clamav command")
+	}
+
+	response, err := readClamAVResponse(conn)
+	if err != nil {
+		return err
+	}
+	if response != "PONG" {
+		return eris.Errorf("unexpected clamav response %q", response)
+	}
+
+	return nil
+}
+
+func (s *ClamAVScanner) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, eris.Wrap(err, "connecting to clamav")
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	return conn, nil
+}
+
+// reply reads and parses the answer to an INSTREAM command, formatted as "stream: OK",
+// "stream: <signature> FOUND" or "<message> ERROR"
+func (s *ClamAVScanner) reply(conn net.Conn) (*ScanResult, error) {
+	response, err := readClamAVResponse(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(response, " ERROR"):
+		return nil, eris.Errorf("clamav error: %s", strings.TrimSuffix(response, " ERROR"))
+	case strings.HasSuffix(response, " FOUND"):
+		signature := strings.TrimSuffix(response, " FOUND")
+		if _, after, found := strings.Cut(signature, ": "); found {
+			signature = after
+		}
+		return &ScanResult{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(response, ": OK"):
+		return &ScanResult{}, nil
+	default:
+		return nil, eris.Errorf("unexpected clamav response %q", response)
+	}
+}
+
+// readClamAVResponse reads a null terminated response, as answered to z prefixed commands
+func readClamAVResponse(conn net.Conn) (string, error) {
+	response, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString(0)
+	if err != nil && (!errors.Is(err, io.EOF) || response == "") {
+		return "", eris.Wrap(err, "reading clamav response")
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(response, "\x00")), nil
+}
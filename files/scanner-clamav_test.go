@@ -0,0 +1,189 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voxtmault/panacea-shared-lib/health"
+)
+
+// fakeClamd accepts a single INSTREAM command per connection and answers with reply once the stream ends, or once
+// more than limit bytes were streamed when limit is positive. A nil reply never answers
+type fakeClamd struct {
+	reply    func(data []byte) string
+	limit    int
+	received chan []byte
+}
+
+func startFakeClamd(t *testing.T, clamd *fakeClamd) *ClamAVScanner {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd.received = make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.serve(conn)
+		}
+	}()
+
+	return &ClamAVScanner{network: "tcp", address: listener.Addr().String(), timeout: time.Second * 2}
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command == "zPING\x00" {
+		conn.Write([]byte("PONG\x00"))
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var data []byte
+	length := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, length); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(length)
+		if size == 0 {
+			break
+		}
+
+		chunk := make([]byte, size)
+		if _, err = io.ReadFull(reader, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+
+		if c.limit > 0 && len(data) > c.limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			// Keep reading so the client gets the reply instead of a reset connection
+			conn.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, reader)
+			return
+		}
+	}
+	c.received <- data
+
+	if c.reply == nil {
+		io.Copy(io.Discard, reader)
+		return
+	}
+	conn.Write([]byte(c.reply(data) + "\x00"))
+}
+
+func TestClamAVScannerClean(t *testing.T) {
+	clamd := &fakeClamd{reply: func([]byte) string { return "stream: OK" }}
+	scanner := startFakeClamd(t, clamd)
+
+	// Larger than a chunk so the content is streamed in several chunks
+	content := bytes.Repeat([]byte("clean content "), clamAVChunkSize/7)
+	result, err := scanner.Scan(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Infected || result.Signature != "" {
+		t.Fatalf("clean content reported as %+v", result)
+	}
+	if received := <-clamd.received; !bytes.Equal(received, content) {
+		t.Fatalf("clamd received %d bytes, want %d", len(received), len(content))
+	}
+}
+
+func TestClamAVScannerFound(t *testing.T) {
+	scanner := startFakeClamd(t, &fakeClamd{reply: func([]byte) string { return "stream: Eicar-Signature FOUND" }})
+
+	result, err := scanner.Scan(context.Background(), strings.NewReader("infected content"))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Fatalf("infected content reported as %+v", result)
+	}
+}
+
+func TestClamAVScannerSizeLimit(t *testing.T) {
+	scanner := startFakeClamd(t, &fakeClamd{reply: func([]byte) string { return "stream: OK" }, limit: clamAVChunkSize})
+
+	content := bytes.Repeat([]byte{'a'}, clamAVChunkSize*8)
+	result, err := scanner.Scan(context.Background(), bytes.NewReader(content))
+	if err == nil || !strings.Contains(err.Error(), "INSTREAM size limit exceeded") {
+		t.Fatalf("Scan returned %+v, %v, want the size limit error", result, err)
+	}
+}
+
+func TestClamAVScannerTimeout(t *testing.T) {
+	scanner := startFakeClamd(t, &fakeClamd{})
+	scanner.timeout = time.Millisecond * 200
+
+	start := time.Now()
+	result, err := scanner.Scan(context.Background(), strings.NewReader("content"))
+	if err == nil {
+		t.Fatalf("Scan returned %+v without a reply", result)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Scan returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Scan took %s, the timeout is %s", elapsed, scanner.timeout)
+	}
+}
+
+func TestClamAVScannerPing(t *testing.T) {
+	scanner := startFakeClamd(t, &fakeClamd{})
+
+	if err := scanner.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestClamAVScannerHealthCheck(t *testing.T) {
+	previous := GetScanner()
+	t.Cleanup(func() { SetScanner(previous) })
+
+	scanner := startFakeClamd(t, &fakeClamd{})
+	SetScanner(scanner)
+
+	report := health.Check(context.Background(), health.Readiness)
+	if result, found := report.Checks[HealthCheckScanner]; !found || result.Status != health.StatusUp {
+		t.Fatalf("scanner check reported as %+v, found: %t", result, found)
+	}
+
+	// An unreachable clamd makes the service unready
+	scanner.address = "127.0.0.1:1"
+	report = health.Check(context.Background(), health.Readiness)
+	if result := report.Checks[HealthCheckScanner]; result.Status != health.StatusDown || report.Status != health.StatusDown {
+		t.Fatalf("unreachable scanner reported as %+v in a %s report", result, report.Status)
+	}
+
+	SetScanner(nil)
+	if _, found := health.Check(context.Background(), health.Readiness).Checks[HealthCheckScanner]; found {
+		t.Fatal("the scanner check is still registered once scanning is disabled")
+	}
+}
@@ -0,0 +1,186 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/voxtmault/panacea-shared-lib/health"
+)
+
+// quarantineFolder holds the uploads flagged by the scanner, they are kept for review and never referenced by a record
+const quarantineFolder = "quarantine"
+
+const ScannerBackendClamAV = "clamav"
+
+// HealthCheckScanner is the name of the readiness check registered for scanners able to ping their backend
+const HealthCheckScanner = "scanner"
+
+var ErrFileInfected = eris.New("file is infected")
+
+// ScanStatus records the outcome of the malware scan of a media
+type ScanStatus string
+
+const (
+	// ScanStatusSkipped is used when no scanner is configured
+	ScanStatusSkipped ScanStatus = "skipped"
+	ScanStatusClean   ScanStatus = "clean"
+
+	// ScanStatusFailed is used when the scanner couldn't be reached and ScanFailOpen accepted the upload anyway
+	ScanStatusFailed ScanStatus = "failed"
+)
+
+// ScanResult is the verdict of a Scanner
+type ScanResult struct {
+	Infected bool `json:"infected"`
+
+	// Signature is the name of the detected threat, empty when the content is clean
+	Signature string `json:"signature"`
+}
+
+// Scanner inspects uploaded content for malware before it is saved
+type Scanner interface {
+	// Scan reads r until EOF and reports whether its content is infected.
+	// An error means the content couldn't be scanned, not that it is infected
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+// pinger is implemented by the scanners able to check their backend is reachable, such as ClamAVScanner
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// InfectedFileError is returned when an upload is flagged by the scanner, the file has been moved to QuarantinePath
+type InfectedFileError struct {
+	Filename       string `json:"filename"`
+	Signature      string `json:"signature"`
+	QuarantinePath string `json:"quarantine_path"`
+}
+
+func (e *InfectedFileError) Error() string {
+	return fmt.Sprintf("%s is infected with %s", e.Filename, e.Signature)
+}
+
+func (e *InfectedFileError) Unwrap() error {
+	return ErrFileInfected
+}
+
+var (
+	scanner      Scanner
+	scannerMutex sync.RWMutex
+)
+
+// InitScanner creates the scanner selected by the ScannerBackend config
+func InitScanner(cfg *config.FileHandlingConfig) error {
+	s, err := NewScanner(cfg)
+	if err != nil {
+		return err
+	}
+
+	SetScanner(s)
+	return nil
+}
+
+// NewScanner returns a new scanner based on the ScannerBackend config, nil is returned when scanning is disabled
+func NewScanner(cfg *config.FileHandlingConfig) (Scanner, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.ScannerBackend)) {
+	case "":
+		return nil, nil
+	case ScannerBackendClamAV:
+		return NewClamAVScanner(cfg)
+	default:
+		return nil, eris.Errorf("unsupported scanner backend %q", cfg.ScannerBackend)
+	}
+}
+
+// SetScanner replaces the scanner used by the package, nil disables scanning. The scanner is registered as a
+// readiness check when it can ping its backend
+func SetScanner(s Scanner) {
+	scannerMutex.Lock()
+	scanner = s
+	scannerMutex.Unlock()
+
+	if _, ok := s.(pinger); ok {
+		health.Register(HealthCheckScanner, health.Readiness, pingScanner)
+	} else {
+		health.Unregister(HealthCheckScanner)
+	}
+}
+
+// pingScanner is the health check of the scanner used by the package
+func pingScanner(ctx context.Context) error {
+	p, ok := GetScanner().(pinger)
+	if !ok {
+		return eris.New("scanner can't be pinged")
+	}
+
+	return p.Ping(ctx)
+}
+
+// GetScanner returns the scanner used by the package, nil when scanning is disabled
+func GetScanner() Scanner {
+	scannerMutex.RLock()
+	defer scannerMutex.RUnlock()
+	return scanner
+}
+
+// scanStored scans a file already written to the file store. Infected files are moved to the quarantine folder
+// and an InfectedFileError is returned, the caller must not use the stored file afterward
+func scanStored(ctx context.Context, fileInfo File) (ScanStatus, error) {
+	s := GetScanner()
+	if s == nil {
+		return ScanStatusSkipped, nil
+	}
+
+	reader, err := OpenFile(ctx, fileInfo)
+	if err != nil {
+		return "", eris.Wrap(err, "opening file to scan")
+	}
+	result, err := s.Scan(ctx, reader)
+	reader.Close()
+
+	if err != nil {
+		if config.GetConfig().FileHandlingConfig.ScanFailOpen {
+			slog.Warn("unable to scan uploaded file, accepting it unscanned", "path", fileInfo.FilePath, "reason", err)
+			return ScanStatusFailed, nil
+		}
+		return "", eris.Wrap(err, "scanning uploaded file")
+	}
+
+	if !result.Infected {
+		return ScanStatusClean, nil
+	}
+
+	infected := &InfectedFileError{Filename: fileInfo.Filename, Signature: result.Signature}
+	if infected.QuarantinePath, err = quarantineFile(ctx, fileInfo.FilePath, fileInfo.Filename); err != nil {
+		slog.Error("unable to quarantine infected file, removing it instead", "path", fileInfo.FilePath, "reason", err)
+		discardUpload(ctx, fileInfo.FilePath)
+	} else {
+		slog.Warn("infected upload quarantined",
+			"filename", fileInfo.Filename,
+			"signature", result.Signature,
+			"quarantine_path", infected.QuarantinePath,
+		)
+	}
+
+	return "", infected
+}
+
+// quarantineFile moves a stored file to the quarantine folder and returns its new path
+func quarantineFile(ctx context.Context, filePath, filename string) (string, error) {
+	target, err := uuidFilePath(quarantineFolder, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if err = moveFile(ctx, GetFileStore(), filePath, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
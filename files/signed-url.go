@@ -0,0 +1,152 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+var (
+	ErrInvalidSignature = eris.New("invalid media url signature")
+	ErrURLExpired       = eris.New("media url has expired")
+)
+
+// Query parameters of a signed media URL
+const (
+	signedURLParamID        = "id"
+	signedURLParamVariant   = "variant"
+	signedURLParamExpires   = "expires"
+	signedURLParamBound     = "bound"
+	signedURLParamSignature = "signature"
+)
+
+// SignedURLOptions customizes a signed media URL
+type SignedURLOptions struct {
+	// Variant of the media to serve (e.g. thumbnail), the original file is served when empty
+	Variant string
+
+	// UserID binds the URL to a single user, anyone holding the URL can use it when empty
+	UserID string
+
+	// TTL is how long the URL stays valid, default to SecurityConfig.MediaURLLifeSpan
+	TTL time.Duration
+}
+
+// SignedMediaRequest is the content of a verified signed media URL
+type SignedMediaRequest struct {
+	MediaID   uint      `json:"media_id"`
+	Variant   string    `json:"variant"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SignMediaURL returns baseURL with the query parameters that allow the media handler to serve the given media
+// until the URL expires
+func SignMediaURL(baseURL string, mediaID uint, opts SignedURLOptions) (string, error) {
+	cfg := config.GetConfig().SecurityConfig
+
+	key, err := mediaURLKey()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", eris.Wrap(err, "parsing base url")
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = time.Minute * time.Duration(cfg.MediaURLLifeSpan)
+	}
+	expires := time.Now().Add(ttl).Unix()
+
+	query := u.Query()
+	query.Set(signedURLParamID, strconv.FormatUint(uint64(mediaID), 10))
+	query.Set(signedURLParamExpires, strconv.FormatInt(expires, 10))
+	if opts.Variant != "" {
+		query.Set(signedURLParamVariant, opts.Variant)
+	}
+	if opts.UserID != "" {
+		// The user id itself is not exposed, it only takes part in the signature
+		query.Set(signedURLParamBound, "1")
+	}
+	query.Set(signedURLParamSignature, signMediaRequest(key, mediaID, opts.Variant, expires, opts.UserID))
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// VerifyMediaURL checks the signature and expiry of a signed media URL. UserID is the user making the request,
+// it is only used when the URL is bound to a user
+func VerifyMediaURL(query url.Values, userID string) (*SignedMediaRequest, error) {
+	key, err := mediaURLKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mediaID, err := strconv.ParseUint(query.Get(signedURLParamID), 10, 0)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	expires, err := strconv.ParseInt(query.Get(signedURLParamExpires), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	if query.Get(signedURLParamBound) != "1" {
+		userID = ""
+	} else if userID == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	variant := query.Get(signedURLParamVariant)
+	expected := signMediaRequest(key, uint(mediaID), variant, expires, userID)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signedURLParamSignature))) {
+		return nil, ErrInvalidSignature
+	}
+
+	// Only checked once the signature is valid so a forged expiry is reported as a bad signature
+	expiresAt := time.Unix(expires, 0)
+	if time.Now().After(expiresAt) {
+		return nil, ErrURLExpired
+	}
+
+	return &SignedMediaRequest{
+		MediaID:   uint(mediaID),
+		Variant:   variant,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// signMediaRequest returns the URL safe HMAC-SHA256 of the signed fields
+func signMediaRequest(key []byte, mediaID uint, variant string, expires int64, userID string) string {
+	payload := strings.Join([]string{
+		strconv.FormatUint(uint64(mediaID), 10),
+		variant,
+		strconv.FormatInt(expires, 10),
+		userID,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func mediaURLKey() ([]byte, error) {
+	key := config.GetConfig().SecurityConfig.MediaURLKey
+	if key == "" {
+		return nil, eris.New("media url signing key is empty")
+	}
+
+	return []byte(key), nil
+}
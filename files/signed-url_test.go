@@ -0,0 +1,172 @@
+package files
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+func setTestMediaURLKey(t *testing.T, key string) {
+	t.Helper()
+
+	t.Setenv("MEDIA_URL_KEY", key)
+	t.Setenv("MEDIA_URL_LIFE_SPAN", "15")
+	config.New("/nonexistent")
+}
+
+// signTestURL signs a media URL and returns its query
+func signTestURL(t *testing.T, mediaID uint, opts SignedURLOptions) url.Values {
+	t.Helper()
+
+	signed, err := SignMediaURL("https://cdn.example.com/media?lang=en", mediaID, opts)
+	if err != nil {
+		t.Fatalf("SignMediaURL: %v", err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parsing signed url: %v", err)
+	}
+
+	return u.Query()
+}
+
+func TestSignedMediaURL(t *testing.T) {
+	setTestMediaURLKey(t, "test-signing-key")
+
+	query := signTestURL(t, 42, SignedURLOptions{Variant: "thumbnail"})
+	if query.Get("lang") != "en" {
+		t.Fatal("the query of the base url was dropped")
+	}
+	if query.Get(signedURLParamBound) != "" {
+		t.Fatal("an unbound url is marked as bound")
+	}
+
+	request, err := VerifyMediaURL(query, "anyone")
+	if err != nil {
+		t.Fatalf("VerifyMediaURL: %v", err)
+	}
+	if request.MediaID != 42 || request.Variant != "thumbnail" || request.UserID != "" {
+		t.Fatalf("verified request is %+v", request)
+	}
+	if remaining := time.Until(request.ExpiresAt); remaining <= time.Minute*14 || remaining > time.Minute*15 {
+		t.Fatalf("url expires in %s, want the 15 minutes life span", remaining)
+	}
+}
+
+func TestSignedMediaURLExpiry(t *testing.T) {
+	setTestMediaURLKey(t, "test-signing-key")
+
+	// A negative TTL falls back to the life span
+	query := signTestURL(t, 42, SignedURLOptions{TTL: -time.Second})
+	if _, err := VerifyMediaURL(query, ""); err != nil {
+		t.Fatalf("VerifyMediaURL: %v", err)
+	}
+
+	// Sign an already expired url the way SignMediaURL does
+	key, _ := mediaURLKey()
+	expires := time.Now().Add(-time.Second).Unix()
+	query = url.Values{
+		signedURLParamID:        {"42"},
+		signedURLParamExpires:   {strconv.FormatInt(expires, 10)},
+		signedURLParamSignature: {signMediaRequest(key, 42, "", expires, "")},
+	}
+	if _, err := VerifyMediaURL(query, ""); !errors.Is(err, ErrURLExpired) {
+		t.Fatalf("VerifyMediaURL of an expired url returned %v, want ErrURLExpired", err)
+	}
+
+	// Pushing the expiry back breaks the signature
+	query.Set(signedURLParamExpires, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if _, err := VerifyMediaURL(query, ""); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("VerifyMediaURL of an extended url returned %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestSignedMediaURLTampering(t *testing.T) {
+	setTestMediaURLKey(t, "test-signing-key")
+
+	tests := []struct {
+		name   string
+		tamper func(query url.Values)
+	}{
+		{name: "id", tamper: func(query url.Values) { query.Set(signedURLParamID, "43") }},
+		{name: "invalid id", tamper: func(query url.Values) { query.Set(signedURLParamID, "abc") }},
+		{name: "missing id", tamper: func(query url.Values) { query.Del(signedURLParamID) }},
+		{name: "variant", tamper: func(query url.Values) { query.Set(signedURLParamVariant, "original") }},
+		{name: "removed variant", tamper: func(query url.Values) { query.Del(signedURLParamVariant) }},
+		{name: "expires", tamper: func(query url.Values) {
+			expires, _ := strconv.ParseInt(query.Get(signedURLParamExpires), 10, 64)
+			query.Set(signedURLParamExpires, strconv.FormatInt(expires+1, 10))
+		}},
+		{name: "invalid expires", tamper: func(query url.Values) { query.Set(signedURLParamExpires, "soon") }},
+		{name: "removed bound", tamper: func(query url.Values) { query.Del(signedURLParamBound) }},
+		{name: "signature", tamper: func(query url.Values) {
+			signature := []byte(query.Get(signedURLParamSignature))
+			signature[0] ^= 1
+			query.Set(signedURLParamSignature, string(signature))
+		}},
+		{name: "missing signature", tamper: func(query url.Values) { query.Del(signedURLParamSignature) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := signTestURL(t, 42, SignedURLOptions{Variant: "thumbnail", UserID: "user-1"})
+			test.tamper(query)
+
+			if request, err := VerifyMediaURL(query, "user-1"); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("VerifyMediaURL returned %+v, %v, want ErrInvalidSignature", request, err)
+			}
+		})
+	}
+}
+
+func TestSignedMediaURLBoundToUser(t *testing.T) {
+	setTestMediaURLKey(t, "test-signing-key")
+
+	query := signTestURL(t, 42, SignedURLOptions{UserID: "user-1"})
+	if query.Get(signedURLParamBound) != "1" {
+		t.Fatal("a bound url isn't marked as bound")
+	}
+	for _, value := range query {
+		if value[0] == "user-1" {
+			t.Fatal("the user id is exposed in the url")
+		}
+	}
+
+	request, err := VerifyMediaURL(query, "user-1")
+	if err != nil {
+		t.Fatalf("VerifyMediaURL: %v", err)
+	}
+	if request.UserID != "user-1" {
+		t.Fatalf("verified request is %+v", request)
+	}
+
+	for _, userID := range []string{"user-2", ""} {
+		if _, err = VerifyMediaURL(query, userID); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("VerifyMediaURL as %q returned %v, want ErrInvalidSignature", userID, err)
+		}
+	}
+}
+
+func TestSignedMediaURLKey(t *testing.T) {
+	setTestMediaURLKey(t, "test-signing-key")
+	query := signTestURL(t, 42, SignedURLOptions{})
+
+	// Rotating the key invalidates the urls signed before
+	setTestMediaURLKey(t, "another-signing-key")
+	if _, err := VerifyMediaURL(query, ""); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("VerifyMediaURL with another key returned %v, want ErrInvalidSignature", err)
+	}
+
+	setTestMediaURLKey(t, "")
+	if _, err := SignMediaURL("https://cdn.example.com/media", 42, SignedURLOptions{}); err == nil {
+		t.Fatal("SignMediaURL succeeded without a key")
+	}
+	if _, err := VerifyMediaURL(query, ""); err == nil {
+		t.Fatal("VerifyMediaURL succeeded without a key")
+	}
+}
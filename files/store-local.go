@@ -0,0 +1,209 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+// LocalStore keeps the files on the local filesystem under a root directory
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates the root directory alongside the category sub directories if they don't exist yet
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, eris.New("file root path is empty")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, eris.Wrap(err, "resolving file root path")
+	}
+
+	for _, folder := range fileCategories {
+		if err = os.MkdirAll(filepath.Join(root, folder), 0755); err != nil {
+			return nil, eris.Wrap(err, "creating category folder")
+		}
+	}
+
+	return &LocalStore{root: root}, nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, path string, r io.Reader, size int64) error {
+	target, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return eris.Wrap(err, "creating parent folder")
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return eris.Wrap(err, "creating file")
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return eris.Wrap(err, "writing file")
+	}
+
+	if err = f.Close(); err != nil {
+		return eris.Wrap(err, "closing file")
+	}
+
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	target, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileNotFound
+		}
+		return nil, eris.Wrap(err, "opening file")
+	}
+
+	return f, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, path string) error {
+	target, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	return DeleteFile(target)
+}
+
+// Move renames the file, replacing the destination if it already exists
+func (s *LocalStore) Move(ctx context.Context, src, dst string) error {
+	source, err := s.resolve(src)
+	if err != nil {
+		return err
+	}
+
+	target, err := s.resolve(dst)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return eris.Wrap(err, "creating parent folder")
+	}
+
+	if err = os.Rename(source, target); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrFileNotFound
+		}
+		return eris.Wrap(err, "moving file")
+	}
+
+	return nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, path string) (*ObjectInfo, error) {
+	target, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileNotFound
+		}
+		return nil, eris.Wrap(err, "reading file info")
+	}
+
+	return &ObjectInfo{
+		Path:    filepath.ToSlash(strings.TrimPrefix(target, s.root+string(filepath.Separator))),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	// Only walk the folder the prefix points to instead of the whole root
+	start := s.root
+	if dir := path.Dir(prefix); dir != "." && dir != "/" {
+		var err error
+		if start, err = s.resolve(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	err := filepath.WalkDir(start, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, fullPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return objects, nil
+		}
+		return nil, eris.Wrap(err, "listing files")
+	}
+
+	return objects, nil
+}
+
+// resolve returns the location of the given path on the local filesystem, guaranteeing it stays within the root
+func (s *LocalStore) resolve(path string) (string, error) {
+	cleaned, err := cleanStorePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(s.root, filepath.FromSlash(cleaned))
+	rel, err := filepath.Rel(s.root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidPath
+	}
+
+	return target, nil
+}
@@ -0,0 +1,89 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreResolve(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStore(root)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		invalid bool
+	}{
+		{path: "photos/a.png", want: filepath.Join(root, "photos", "a.png")},
+		{path: "photos/sub/../a.png", invalid: true},
+		{path: "../outside", invalid: true},
+		{path: "photos/../../outside", invalid: true},
+		{path: `..\outside`, invalid: true},
+		{path: "/etc/passwd", invalid: true},
+		{path: "photos/a\x00.png", invalid: true},
+		{path: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := store.resolve(test.path)
+		if test.invalid {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("resolve(%q) = %q, %v, want ErrInvalidPath", test.path, got, err)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("resolve(%q) = %q, %v, want %q", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestLocalStoreRejectsEscapingPaths(t *testing.T) {
+	parent := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(parent, "root"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	ctx := context.Background()
+
+	outside := filepath.Join(parent, "outside")
+	if err = os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+
+	if err = store.Put(ctx, "../outside", bytes.NewReader([]byte("overwritten")), 11); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("Put outside the root returned %v, want ErrInvalidPath", err)
+	}
+	if reader, err := store.Get(ctx, "../outside"); !errors.Is(err, ErrInvalidPath) {
+		if reader != nil {
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+			t.Fatalf("Get outside the root returned %q, want ErrInvalidPath", content)
+		}
+		t.Fatalf("Get outside the root returned %v, want ErrInvalidPath", err)
+	}
+	if err = store.Delete(ctx, "../outside"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("Delete outside the root returned %v, want ErrInvalidPath", err)
+	}
+
+	if err = store.Put(ctx, "documents/inside", bytes.NewReader([]byte("inside")), 6); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err = store.Move(ctx, "documents/inside", "../outside"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("Move outside the root returned %v, want ErrInvalidPath", err)
+	}
+
+	content, err := os.ReadFile(outside)
+	if err != nil || string(content) != "secret" {
+		t.Fatalf("the file outside the root was modified: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,607 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+const (
+	s3Service         = "s3"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+
+	// s3PartSize is the size of the parts of a multipart upload, S3 requires at least 5 MiB for every part but the last
+	s3PartSize = 8 << 20
+)
+
+// emptyPayloadHash is the hex encoded sha256 of an empty body
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// S3Store keeps the files in an S3 compatible object storage (AWS S3, MinIO, etc).
+// Requests are signed with AWS Signature Version 4
+type S3Store struct {
+	endpoint   string
+	scheme     string
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	partSize   int
+	httpClient *http.Client
+}
+
+func validateS3Config(cfg *config.FileHandlingConfig) error {
+	if cfg.S3Endpoint == "" {
+		return eris.New("s3 endpoint is empty")
+	}
+	if cfg.S3Bucket == "" {
+		return eris.New("s3 bucket is empty")
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return eris.New("s3 credentials are empty")
+	}
+
+	return nil
+}
+
+func NewS3Store(cfg *config.FileHandlingConfig) (*S3Store, error) {
+	if err := validateS3Config(cfg); err != nil {
+		return nil, eris.Wrap(err, "invalid s3 configuration")
+	}
+
+	store := &S3Store{
+		endpoint:   cfg.S3Endpoint,
+		scheme:     "https",
+		region:     cfg.S3Region,
+		bucket:     cfg.S3Bucket,
+		accessKey:  cfg.S3AccessKey,
+		secretKey:  cfg.S3SecretKey,
+		pathStyle:  cfg.S3UsePathStyle,
+		partSize:   s3PartSize,
+		httpClient: &http.Client{Timeout: time.Minute * 5},
+	}
+
+	// Allow the endpoint to be written with or without its scheme
+	if u, err := url.Parse(cfg.S3Endpoint); err == nil && u.Host != "" {
+		store.endpoint = u.Host
+		store.scheme = u.Scheme
+	} else if !cfg.S3UseSSL {
+		store.scheme = "http"
+	}
+
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+
+	return store, nil
+}
+
+// SetHTTPClient replaces the http client used to talk to the object storage
+func (s *S3Store) SetHTTPClient(client *http.Client) {
+	s.httpClient = client
+}
+
+// Put uploads the object in a single request when its size is known. Otherwise S3 still requires the content length
+// upfront, so the content is sent part by part with a multipart upload, keeping a single part in memory
+func (s *S3Store) Put(ctx context.Context, path string, r io.Reader, size int64) error {
+	if size >= 0 {
+		return s.putObject(ctx, path, r, size)
+	}
+
+	part := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, part)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		// The content fits in a single part
+		return s.putObject(ctx, path, bytes.NewReader(part[:n]), int64(n))
+	case err != nil:
+		return eris.Wrap(err, "reading file content")
+	}
+
+	return s.putMultipart(ctx, path, r, part)
+}
+
+func (s *S3Store) putObject(ctx context.Context, path string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, path, nil, nil, io.NopCloser(r), size)
+	if err != nil {
+		return eris.Wrap(err, "uploading object")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, "uploading object")
+	}
+
+	return nil
+}
+
+type s3InitiateMultipartResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// putMultipart uploads first then the rest of r as the parts of a multipart upload, the upload is aborted on failure
+// so the parts already sent don't linger in the bucket
+func (s *S3Store) putMultipart(ctx context.Context, path string, r io.Reader, first []byte) error {
+	uploadID, err := s.createMultipartUpload(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if err = s.uploadParts(ctx, path, uploadID, r, first); err != nil {
+		// The request context may be the reason of the failure, the abort must still be sent
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*30)
+		defer cancel()
+		if abortErr := s.abortMultipartUpload(abortCtx, path, uploadID); abortErr != nil {
+			slog.Warn("unable to abort multipart upload", "path", path, "upload_id", uploadID, "reason", abortErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3Store) createMultipartUpload(ctx context.Context, path string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+
+	resp, err := s.do(ctx, http.MethodPost, path, query, nil, nil, 0)
+	if err != nil {
+		return "", eris.Wrap(err, "creating multipart upload")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", s.responseError(resp, "creating multipart upload")
+	}
+
+	var result s3InitiateMultipartResult
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", eris.Wrap(err, "decoding multipart upload")
+	}
+	if result.UploadID == "" {
+		return "", eris.New("creating multipart upload: missing upload id")
+	}
+
+	return result.UploadID, nil
+}
+
+// uploadParts sends part, then reads and sends the following parts of r reusing the buffer of part
+func (s *S3Store) uploadParts(ctx context.Context, path, uploadID string, r io.Reader, part []byte) error {
+	var completed s3CompleteMultipartUpload
+
+	for number := 1; len(part) > 0; number++ {
+		etag, err := s.uploadPart(ctx, path, uploadID, number, part)
+		if err != nil {
+			return err
+		}
+		completed.Parts = append(completed.Parts, s3CompletedPart{PartNumber: number, ETag: etag})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return eris.Wrap(err, "reading file content")
+		}
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return eris.Wrap(err, "encoding multipart upload parts")
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	resp, err := s.do(ctx, http.MethodPost, path, query, nil, io.NopCloser(bytes.NewReader(body)), int64(len(body)))
+	if err != nil {
+		return eris.Wrap(err, "completing multipart upload")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp, "completing multipart upload")
+	}
+
+	// The completion may fail after the status has been sent, the error is then in the body
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return eris.Wrap(err, "reading multipart upload completion")
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return s.responseError(&http.Response{Status: resp.Status, Body: io.NopCloser(bytes.NewReader(data))},
+			"completing multipart upload")
+	}
+
+	return nil
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, path, uploadID string, number int, part []byte) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(number))
+	query.Set("uploadId", uploadID)
+
+	resp, err := s.do(ctx, http.MethodPut, path, query, nil, io.NopCloser(bytes.NewReader(part)), int64(len(part)))
+	if err != nil {
+		return "", eris.Wrapf(err, "uploading part %d", number)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", s.responseError(resp, fmt.Sprintf("uploading part %d", number))
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", eris.Errorf("uploading part %d: missing etag", number)
+	}
+
+	return etag, nil
+}
+
+func (s *S3Store) abortMultipartUpload(ctx context.Context, path, uploadID string) error {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	resp, err := s.do(ctx, http.MethodDelete, path, query, nil, nil, 0)
+	if err != nil {
+		return eris.Wrap(err, "aborting multipart upload")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s.responseError(resp, "aborting multipart upload")
+	}
+}
+
+func (s *S3Store) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, path, nil, nil, nil, 0)
+	if err != nil {
+		return nil, eris.Wrap(err, "downloading object")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrFileNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s.responseError(resp, "downloading object")
+	}
+}
+
+// GetRange opens length bytes of the object starting at offset
+func (s *S3Store) GetRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.do(ctx, http.MethodGet, path, nil, header, nil, 0)
+	if err != nil {
+		return nil, eris.Wrap(err, "downloading object range")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		// The range was ignored and the whole object is returned, skip to the requested offset
+		if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, eris.Wrap(err, "skipping to the requested range")
+		}
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrFileNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s.responseError(resp, "downloading object range")
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, path string) error {
+	resp, err := s.do(ctx, http.MethodDelete, path, nil, nil, nil, 0)
+	if err != nil {
+		return eris.Wrap(err, "deleting object")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s.responseError(resp, "deleting object")
+	}
+}
+
+func (s *S3Store) Stat(ctx context.Context, path string) (*ObjectInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, path, nil, nil, nil, 0)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading object info")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrFileNotFound
+	default:
+		return nil, s.responseError(resp, "reading object info")
+	}
+
+	info := &ObjectInfo{Path: path, Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+
+	return info, nil
+}
+
+// Move copies the object server side then deletes the source
+func (s *S3Store) Move(ctx context.Context, src, dst string) error {
+	header := http.Header{}
+	src, err := cleanStorePath(src)
+	if err != nil {
+		return err
+	}
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+s.bucket+"/"+src, false))
+
+	resp, err := s.do(ctx, http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return eris.Wrap(err, "copying object")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrFileNotFound
+	default:
+		return s.responseError(resp, "copying object")
+	}
+
+	return s.Delete(ctx, src)
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	var token string
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, eris.Wrap(err, "listing objects")
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = s.responseError(resp, "listing objects")
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, eris.Wrap(err, "decoding object list")
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Path:    content.Key,
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+// do builds, signs and sends a request for the given object key
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.ReadCloser, size int64) (*http.Response, error) {
+	if key != "" {
+		var err error
+		if key, err = cleanStorePath(key); err != nil {
+			return nil, err
+		}
+	}
+
+	host := s.endpoint
+	objectPath := "/" + key
+	if s.pathStyle {
+		objectPath = "/" + s.bucket + objectPath
+	} else {
+		host = s.bucket + "." + s.endpoint
+	}
+
+	reqURL := &url.URL{
+		Scheme:   s.scheme,
+		Host:     host,
+		Path:     objectPath,
+		RawPath:  s3Escape(objectPath, false),
+		RawQuery: s3CanonicalQuery(query),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		req.Body = body
+		req.ContentLength = size
+		if size == 0 {
+			// Prevents the client from falling back to chunked encoding for empty files
+			req.Body = http.NoBody
+		}
+		payloadHash = s3UnsignedPayload
+	}
+
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	return s.httpClient.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(s3DateFormat), s.region, s3Service)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+s.secretKey), []byte(now.Format(s3DateFormat)))
+	signingKey = s3HMAC(signingKey, []byte(s.region))
+	signingKey = s3HMAC(signingKey, []byte(s3Service))
+	signingKey = s3HMAC(signingKey, []byte("aws4_request"))
+	signature := hex.EncodeToString(s3HMAC(signingKey, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// responseError reads the error returned by the object storage
+func (s *S3Store) responseError(resp *http.Response, operation string) error {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := xml.Unmarshal(body, &s3Err); err == nil && s3Err.Code != "" {
+		return eris.Errorf("%s: %s (%s)", operation, s3Err.Message, s3Err.Code)
+	}
+
+	return eris.Errorf("%s: unexpected status %s", operation, resp.Status)
+}
+
+func s3HMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query sorted by key as required by Signature Version 4
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes every byte except the unreserved characters, slashes are kept
+// as is unless encodeSlash is set
+func s3Escape(value string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,111 @@
+package files
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+var ErrFileNotFound = eris.New("file not found")
+
+// ObjectInfo describes a file kept in a FileStore
+type ObjectInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// FileStore abstracts where the files are physically kept. Paths are always slash separated
+// and relative to the root of the store, which is the same value saved in File.FilePath
+type FileStore interface {
+	// Put writes the content of r to the given path, truncating it if it already exists.
+	// Size is the length of the content, or -1 if unknown
+	Put(ctx context.Context, path string, r io.Reader, size int64) error
+
+	// Get opens the file on the given path, the caller is responsible for closing it.
+	// Returns ErrFileNotFound if the file does not exist
+	Get(ctx context.Context, path string) (io.ReadCloser, error)
+
+	// Delete removes the file on the given path, deleting a missing file is not an error
+	Delete(ctx context.Context, path string) error
+
+	// Stat returns the information of the file on the given path.
+	// Returns ErrFileNotFound if the file does not exist
+	Stat(ctx context.Context, path string) (*ObjectInfo, error)
+
+	// List returns every file whose path starts with the given prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+var (
+	fileStore      FileStore
+	fileStoreMutex sync.RWMutex
+)
+
+// InitFileStore creates the file store selected by the StorageBackend config
+func InitFileStore(cfg *config.FileHandlingConfig) error {
+	store, err := NewFileStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	SetFileStore(store)
+	return nil
+}
+
+// NewFileStore returns a new file store based on the StorageBackend config
+func NewFileStore(cfg *config.FileHandlingConfig) (FileStore, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.StorageBackend)) {
+	case "", StorageBackendLocal:
+		return NewLocalStore(cfg.FileRootPath)
+	case StorageBackendS3:
+		return NewS3Store(cfg)
+	default:
+		return nil, eris.Errorf("unsupported storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// SetFileStore replaces the file store used by the package
+func SetFileStore(store FileStore) {
+	fileStoreMutex.Lock()
+	defer fileStoreMutex.Unlock()
+	fileStore = store
+}
+
+// GetFileStore returns the file store used by the package.
+//
+// If InitFileStore was never called, a local store rooted on FileRootPath is used
+func GetFileStore() FileStore {
+	fileStoreMutex.RLock()
+	store := fileStore
+	fileStoreMutex.RUnlock()
+
+	if store != nil {
+		return store
+	}
+
+	fileStoreMutex.Lock()
+	defer fileStoreMutex.Unlock()
+	if fileStore == nil {
+		root := config.GetConfig().FileHandlingConfig.FileRootPath
+		localStore, err := NewLocalStore(root)
+		if err != nil {
+			slog.Error("unable to prepare the local file store", "root", root, "reason", err)
+			localStore = &LocalStore{root: root}
+		}
+		fileStore = localStore
+	}
+
+	return fileStore
+}
@@ -0,0 +1,206 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"mime/multipart"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+var ErrFileTooLarge = eris.New("file exceeds the maximum allowed size")
+
+// noUploadLimit disables the size limit of an uploadReader
+const noUploadLimit = -1
+
+// storedUpload is a file written to the file store by storeStream, waiting for its database entry
+type storedUpload struct {
+	File
+
+	// Created reports whether the upload produced a new file, it is false when content addressing reused an existing blob
+	Created bool
+
+	// shared is set for hash derived paths, which other media may reference too
+	shared bool
+
+	// stagedPath holds the scanned upload until claimUpload moves it to its hash derived FilePath, empty once claimed
+	// and for uploads stored under a random path
+	stagedPath string
+
+	ScanStatus ScanStatus
+}
+
+// uploadReader hashes and counts every byte read from the upload while enforcing the size limit,
+// allowing the upload to be written to the file store in a single pass. A limit of 0 accepts no byte at all,
+// use noUploadLimit to disable it
+type uploadReader struct {
+	r     io.Reader
+	hash  hash.Hash
+	size  int64
+	limit int64
+}
+
+func newUploadReader(r io.Reader, limit int64) *uploadReader {
+	return &uploadReader{
+		r:     r,
+		hash:  sha256.New(),
+		limit: limit,
+	}
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if n > 0 {
+		u.size += int64(n)
+		if u.limit >= 0 && u.size > u.limit {
+			return 0, ErrFileTooLarge
+		}
+		u.hash.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// Sum returns the hex encoded sha256 of everything read so far
+func (u *uploadReader) Sum() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
+
+// maxUploadSize returns the configured MaxFileSize in bytes, 0 means no limit
+func maxUploadSize() int64 {
+	return int64(config.GetConfig().FileHandlingConfig.MaxFileSize) * 1024 * 1024
+}
+
+// storeUpload streams the uploaded file into the file store, see storeStream
+func storeUpload(ctx context.Context, file *multipart.FileHeader, encrypt bool) (storedUpload, error) {
+	fileReader, err := file.Open()
+	if err != nil {
+		return storedUpload{}, eris.Wrap(err, "opening uploaded file")
+	}
+	defer fileReader.Close()
+
+	return storeStream(ctx, file.Filename, fileReader, file.Size, encrypt)
+}
+
+// storeStream streams the file content into the file store, hashing and measuring it along the way.
+// Size is the length announced by the client, or -1 if unknown. Any partially written file is removed if the upload fails.
+//
+// Encrypt stores the file encrypted with the current media encryption key. The file is staged under a temporary path and
+// goes through the configured scanner before it is given its final path, so an infected file is never reachable.
+// Infected files are quarantined and an InfectedFileError is returned. Hash named uploads only get their final path
+// from claimUpload, within the transaction saving their record
+func storeStream(ctx context.Context, filename string, fileReader io.Reader, size int64, encrypt bool) (upload storedUpload, err error) {
+	cfg := config.GetConfig().FileHandlingConfig
+
+	// The client filename is kept as metadata only, the stored name is generated
+	upload.Filename = sanitizeFilename(filename)
+
+	// Sniff the leading bytes to verify the content matches the declared file extension
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(fileReader, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return upload, eris.Wrap(err, "reading uploaded file")
+	}
+	head = head[:n]
+
+	_, declared := getFileExtension(filename)
+	var designatedFolder string
+	upload.MIMEType, designatedFolder, err = validateContentType(upload.Filename, declared, detectContentType(head))
+	if err != nil {
+		return upload, err
+	}
+
+	tooLarge := &ValidationError{
+		Kind:         ValidationErrorKindTooLarge,
+		Filename:     upload.Filename,
+		Category:     designatedFolder,
+		DeclaredType: declared,
+		DetectedType: upload.MIMEType,
+	}
+
+	// Reject early when the client already told us the file is too big
+	limit := categoryMaxUploadSize(designatedFolder)
+	if limit > 0 && size > limit {
+		return upload, tooLarge
+	}
+
+	if encrypt {
+		if upload.EncryptionKeyVersion, err = currentEncryptionKeyVersion(); err != nil {
+			return upload, err
+		}
+	}
+
+	// Hash derived paths are only known once the whole file has been hashed. Encrypted files always get a random path,
+	// a hash derived one would leak their content hash and couldn't be shared with files sealed under another nonce
+	hashNamed := !encrypt && (cfg.ContentAddressed || cfg.NamingStrategy == NamingStrategyHash)
+	if upload.FilePath, err = tempUploadPath(); err != nil {
+		return upload, err
+	}
+
+	readerLimit := limit
+	if readerLimit <= 0 {
+		readerLimit = noUploadLimit
+	}
+	reader := newUploadReader(io.MultiReader(bytes.NewReader(head), fileReader), readerLimit)
+	content, storedSize, err := sealReader(reader, size, upload.EncryptionKeyVersion)
+	if err != nil {
+		return upload, err
+	}
+
+	if err = GetFileStore().Put(ctx, upload.FilePath, content, storedSize); err != nil {
+		discardUpload(ctx, upload.FilePath)
+		if errors.Is(err, ErrFileTooLarge) {
+			return upload, tooLarge
+		}
+		return upload, eris.Wrap(err, "storing uploaded file")
+	}
+
+	upload.HashValue = reader.Sum()
+	upload.Size = uint(reader.size)
+	upload.Created = true
+
+	// Scan before the file gets its final path so an infected file is never served nor replaces a shared blob
+	if upload.ScanStatus, err = scanStored(ctx, upload.File); err != nil {
+		if !errors.Is(err, ErrFileInfected) {
+			discardUpload(ctx, upload.FilePath)
+		}
+		return upload, err
+	}
+
+	// A hash derived path may be shared with other media, the upload stays staged until claimUpload moves it there
+	// under the lock of the path
+	tempPath := upload.FilePath
+	switch {
+	case !hashNamed:
+		if upload.FilePath, err = uuidFilePath(designatedFolder, upload.Filename); err != nil {
+			discardUpload(ctx, tempPath)
+			return upload, err
+		}
+		if err = moveFile(ctx, GetFileStore(), tempPath, upload.FilePath); err != nil {
+			discardUpload(ctx, tempPath)
+			return upload, eris.Wrap(err, "moving upload to its final path")
+		}
+	case cfg.ContentAddressed:
+		upload.FilePath = contentAddressedPath(upload.HashValue)
+		upload.shared, upload.stagedPath, upload.Created = true, tempPath, false
+	default:
+		upload.FilePath = hashFilePath(designatedFolder, upload.Filename, upload.HashValue)
+		upload.shared, upload.stagedPath, upload.Created = true, tempPath, false
+	}
+
+	return upload, nil
+}
+
+// discardUpload removes a stored upload whose database entry could not be saved
+func discardUpload(ctx context.Context, filePath string) {
+	if err := GetFileStore().Delete(ctx, filePath); err != nil {
+		slog.Error("unable to clean up uploaded file", "path", filePath, "reason", err)
+	}
+}
@@ -0,0 +1,306 @@
+package files
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+// sniffLength is the amount of bytes inspected to detect the content type of an upload
+const sniffLength = 512
+
+const genericMIMEType = "application/octet-stream"
+
+type ValidationErrorKind string
+
+const (
+	ValidationErrorKindTypeMismatch   = ValidationErrorKind("Type Mismatch")
+	ValidationErrorKindTypeNotAllowed = ValidationErrorKind("Type Not Allowed")
+	ValidationErrorKindTooLarge       = ValidationErrorKind("File Too Large")
+)
+
+// ValidationError is returned when an upload is rejected because of its content
+type ValidationError struct {
+	Kind         ValidationErrorKind `json:"kind"`
+	Filename     string              `json:"filename"`
+	Category     string              `json:"category"`
+	DeclaredType string              `json:"declared_type"`
+	DetectedType string              `json:"detected_type"`
+}
+
+func (e *ValidationError) Error() string {
+	switch e.Kind {
+	case ValidationErrorKindTypeMismatch:
+		return fmt.Sprintf("%s: %s is declared as %q but its content is %q", e.Kind, e.Filename, e.DeclaredType, e.DetectedType)
+	case ValidationErrorKindTypeNotAllowed:
+		return fmt.Sprintf("%s: %q is not allowed in %s", e.Kind, e.DetectedType, e.Category)
+	default:
+		return fmt.Sprintf("%s: %s", e.Kind, e.Filename)
+	}
+}
+
+// Unwrap allows errors.Is(err, ErrFileTooLarge) to keep working for size violations
+func (e *ValidationError) Unwrap() error {
+	if e.Kind == ValidationErrorKindTooLarge {
+		return ErrFileTooLarge
+	}
+
+	return nil
+}
+
+// signature is a magic byte prefix that http.DetectContentType doesn't know about
+type signature struct {
+	prefix   []byte
+	mimeType string
+}
+
+// executableSignatures are checked before the standard sniffing so executables are never reported as
+// a generic binary
+var executableSignatures = []signature{
+	{prefix: []byte("MZ"), mimeType: "application/vnd.microsoft.portable-executable"},
+	{prefix: []byte("\x7fELF"), mimeType: "application/x-executable"},
+	{prefix: []byte("\xfe\xed\xfa\xce"), mimeType: "application/x-mach-binary"},
+	{prefix: []byte("\xfe\xed\xfa\xcf"), mimeType: "application/x-mach-binary"},
+	{prefix: []byte("\xce\xfa\xed\xfe"), mimeType: "application/x-mach-binary"},
+	{prefix: []byte("\xcf\xfa\xed\xfe"), mimeType: "application/x-mach-binary"},
+	{prefix: []byte("#!"), mimeType: "text/x-shellscript"},
+}
+
+// detectContentType returns the MIME type of the content based on its leading bytes
+func detectContentType(head []byte) string {
+	for _, sig := range executableSignatures {
+		if bytes.HasPrefix(head, sig.prefix) {
+			return sig.mimeType
+		}
+	}
+
+	return baseMIMEType(http.DetectContentType(head))
+}
+
+// baseMIMEType strips parameters such as charset from a MIME type
+func baseMIMEType(mimeType string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+
+	return strings.TrimSpace(strings.Split(mimeType, ";")[0])
+}
+
+// validateContentType compares the type declared by the file extension with the detected one and checks it against
+// the allow-list of its category. The detected type is used when the declared one is missing or generic. Returns the
+// MIME type to be stored and the designated folder
+func validateContentType(filename, declared, detected string) (string, string, error) {
+	declared = baseMIMEType(declared)
+
+	mimeType := declared
+	if declared == "" || declared == genericMIMEType {
+		mimeType = detected
+	} else if !typesAgree(declared, detected) || !genericContentAllowed(declared, detected) {
+		return "", "", &ValidationError{
+			Kind:         ValidationErrorKindTypeMismatch,
+			Filename:     filename,
+			Category:     getDesignatedFolder(declared),
+			DeclaredType: declared,
+			DetectedType: detected,
+		}
+	}
+
+	// Executables, declared or only detected, must be named in the allow-list of their category
+	designatedFolder := getDesignatedFolder(mimeType)
+	if !isTypeAllowed(designatedFolder, mimeType) || isExecutable(canonicalMIMEType(mimeType)) && !isTypeListed(designatedFolder, mimeType) {
+		return "", "", &ValidationError{
+			Kind:         ValidationErrorKindTypeNotAllowed,
+			Filename:     filename,
+			Category:     designatedFolder,
+			DeclaredType: declared,
+			DetectedType: mimeType,
+		}
+	}
+
+	return mimeType, designatedFolder, nil
+}
+
+// mimeAliases maps the alternative names of a MIME type, as returned by extensions or sniffing, to a single name
+var mimeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-png":                  "image/png",
+	"image/x-ms-bmp":               "image/bmp",
+	"image/x-icon":                 "image/vnd.microsoft.icon",
+	"text/xml":                     "application/xml",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/wav":                    "audio/wave",
+	"audio/x-wav":                  "audio/wave",
+	"audio/vnd.wave":               "audio/wave",
+	"video/x-msvideo":              "video/avi",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-gzip":           "application/gzip",
+	"application/x-rar":            "application/x-rar-compressed",
+	"application/vnd.rar":          "application/x-rar-compressed",
+}
+
+// containerTypes lists the declared types whose content is sniffed as the generic container they are built on
+var containerTypes = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.oasis.opendocument.presentation",
+		"application/epub+zip",
+		"application/java-archive",
+	},
+	"video/mp4":       {"audio/mp4", "audio/x-m4a", "video/quicktime"},
+	"application/xml": {"image/svg+xml", "application/rss+xml", "application/atom+xml", "application/xhtml+xml"},
+}
+
+// unsniffableTypes are declared types whose content has no signature known to the sniffer, they are accepted
+// when their content is detected as generic binary
+var unsniffableTypes = map[string]bool{
+	"application/msword":            true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/vnd.ms-outlook":    true,
+}
+
+// canonicalMIMEType resolves the aliases of a MIME type
+func canonicalMIMEType(mimeType string) string {
+	if canonical, found := mimeAliases[mimeType]; found {
+		return canonical
+	}
+
+	return mimeType
+}
+
+// typesAgree reports whether the detected content is consistent with the declared type. Types agree when they are
+// the same concrete type, aliases included, or when the declared type is built on the detected container
+func typesAgree(declared, detected string) bool {
+	declared, detected = canonicalMIMEType(declared), canonicalMIMEType(detected)
+	if declared == detected {
+		return true
+	}
+
+	// Executables are never allowed to hide behind another type
+	if isExecutable(detected) || isExecutable(declared) {
+		return isExecutable(detected) && isExecutable(declared)
+	}
+
+	// Generic binary content is checked by genericContentAllowed
+	if detected == genericMIMEType {
+		return true
+	}
+
+	// JSON, CSV, SVG and the likes are sniffed as plain text
+	if detected == "text/plain" {
+		return isTextual(declared)
+	}
+
+	for _, containedType := range containerTypes[detected] {
+		if canonicalMIMEType(containedType) == declared {
+			return true
+		}
+	}
+
+	return false
+}
+
+// genericContentAllowed reports whether content the sniffer doesn't recognize can be stored under the declared type.
+// It is only accepted for known unsniffable types and those listed in the GenericContentTypes of their category,
+// otherwise any binary renamed with an allowed extension would be stored under that category
+func genericContentAllowed(declared, detected string) bool {
+	declared = canonicalMIMEType(declared)
+	if detected != genericMIMEType || declared == genericMIMEType {
+		return true
+	}
+	if unsniffableTypes[declared] {
+		return true
+	}
+
+	for _, allowed := range config.GetConfig().FileHandlingConfig.GenericContentTypes[getDesignatedFolder(declared)] {
+		if canonicalMIMEType(strings.ToLower(strings.TrimSpace(allowed))) == declared {
+			return true
+		}
+	}
+
+	return false
+}
+
+// executableMIMETypes lists the types used for native executables and scripts
+var executableMIMETypes = map[string]bool{
+	"application/vnd.microsoft.portable-executable": true,
+	"application/x-msdownload":                      true,
+	"application/x-msdos-program":                   true,
+	"application/x-dosexec":                         true,
+	"application/x-executable":                      true,
+	"application/x-mach-binary":                     true,
+	"application/x-sh":                              true,
+	"text/x-shellscript":                            true,
+}
+
+// isExecutable reports whether the MIME type describes a native executable or a script
+func isExecutable(mimeType string) bool {
+	return executableMIMETypes[mimeType]
+}
+
+// isTextual reports whether the MIME type describes human readable content
+func isTextual(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+
+	for _, marker := range []string{"json", "xml", "javascript", "csv", "yaml"} {
+		if strings.Contains(mimeType, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTypeAllowed checks the MIME type against the allow-list of the category, categories without an allow-list
+// accept every type
+func isTypeAllowed(category, mimeType string) bool {
+	allowed, exists := config.GetConfig().FileHandlingConfig.AllowedMIMETypes[category]
+	if !exists {
+		return true
+	}
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == mimeType {
+			return true
+		}
+		if prefix, found := strings.CutSuffix(pattern, "/*"); found && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTypeListed reports whether the MIME type is named in the allow-list of the category, wildcards and categories
+// without an allow-list don't count
+func isTypeListed(category, mimeType string) bool {
+	for _, allowed := range config.GetConfig().FileHandlingConfig.AllowedMIMETypes[category] {
+		if canonicalMIMEType(strings.ToLower(strings.TrimSpace(allowed))) == canonicalMIMEType(mimeType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// categoryMaxUploadSize returns the size limit of the category in bytes, falling back to MaxFileSize.
+// 0 means no limit
+func categoryMaxUploadSize(category string) int64 {
+	if limit, exists := config.GetConfig().FileHandlingConfig.CategoryMaxFileSize[category]; exists {
+		return int64(limit) * 1024 * 1024
+	}
+
+	return maxUploadSize()
+}
@@ -0,0 +1,102 @@
+package files
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+func TestValidateContentType(t *testing.T) {
+	t.Setenv("FILE_ALLOWED_MIME_TYPES", "photos:image/png,image/jpeg;applications:application/*,application/x-executable;plaintexts:text/*")
+	t.Setenv("FILE_GENERIC_CONTENT_TYPES", "")
+	config.New("/nonexistent")
+
+	const (
+		portableExecutable = "application/vnd.microsoft.portable-executable"
+		elfExecutable      = "application/x-executable"
+		shellScript        = "text/x-shellscript"
+	)
+
+	tests := []struct {
+		name       string
+		declared   string
+		detected   string
+		wantType   string
+		wantFolder string
+		wantKind   ValidationErrorKind
+	}{
+		{name: "matching", declared: "image/png", detected: "image/png", wantType: "image/png", wantFolder: "photos"},
+		{name: "alias", declared: "audio/mp3", detected: "audio/mpeg", wantType: "audio/mp3", wantFolder: "audios"},
+		{name: "parameters", declared: "text/plain; charset=utf-8", detected: "text/plain", wantType: "text/plain", wantFolder: "plaintexts"},
+		{name: "container", declared: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", detected: "application/zip",
+			wantType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", wantFolder: "applications"},
+		{name: "textual", declared: "application/json", detected: "text/plain", wantType: "application/json", wantFolder: "applications"},
+		{name: "not allowed", declared: "image/gif", detected: "image/gif", wantKind: ValidationErrorKindTypeNotAllowed},
+
+		// Mismatched content
+		{name: "mismatch", declared: "image/png", detected: "application/pdf", wantKind: ValidationErrorKindTypeMismatch},
+		{name: "text as image", declared: "image/png", detected: "text/plain", wantKind: ValidationErrorKindTypeMismatch},
+		{name: "executable as document", declared: "application/pdf", detected: portableExecutable, wantKind: ValidationErrorKindTypeMismatch},
+		{name: "script as text", declared: "text/plain", detected: shellScript, wantKind: ValidationErrorKindTypeMismatch},
+
+		// Generic content or declaration
+		{name: "generic content", declared: "application/pdf", detected: genericMIMEType, wantKind: ValidationErrorKindTypeMismatch},
+		{name: "unsniffable", declared: "application/msword", detected: genericMIMEType, wantType: "application/msword", wantFolder: "applications"},
+		{name: "undeclared", declared: "", detected: "application/pdf", wantType: "application/pdf", wantFolder: "applications"},
+		{name: "generic declaration", declared: genericMIMEType, detected: "image/png", wantType: "image/png", wantFolder: "photos"},
+		{name: "generic both", declared: genericMIMEType, detected: genericMIMEType, wantType: genericMIMEType, wantFolder: "applications"},
+
+		// Executables are only accepted when their type is listed, wildcards aren't enough
+		{name: "undeclared executable", declared: "", detected: portableExecutable, wantKind: ValidationErrorKindTypeNotAllowed},
+		{name: "generic executable", declared: genericMIMEType, detected: portableExecutable, wantKind: ValidationErrorKindTypeNotAllowed},
+		{name: "undeclared script", declared: "", detected: shellScript, wantKind: ValidationErrorKindTypeNotAllowed},
+		{name: "declared executable", declared: "application/x-msdownload", detected: portableExecutable, wantKind: ValidationErrorKindTypeNotAllowed},
+		{name: "listed executable", declared: "", detected: elfExecutable, wantType: elfExecutable, wantFolder: "applications"},
+		{name: "listed declared executable", declared: elfExecutable, detected: elfExecutable, wantType: elfExecutable, wantFolder: "applications"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mimeType, folder, err := validateContentType("upload", test.declared, test.detected)
+
+			if test.wantKind != "" {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || validationErr.Kind != test.wantKind {
+					t.Fatalf("validateContentType(%q, %q) returned %q, %q, %v, want a %s error",
+						test.declared, test.detected, mimeType, folder, err, test.wantKind)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("validateContentType(%q, %q): %v", test.declared, test.detected, err)
+			}
+			if mimeType != test.wantType || folder != test.wantFolder {
+				t.Fatalf("validateContentType(%q, %q) = %q, %q, want %q, %q",
+					test.declared, test.detected, mimeType, folder, test.wantType, test.wantFolder)
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		head []byte
+		want string
+	}{
+		{head: []byte("MZ\x90\x00\x03\x00\x00\x00"), want: "application/vnd.microsoft.portable-executable"},
+		{head: []byte("\x7fELF\x02\x01\x01\x00"), want: "application/x-executable"},
+		{head: []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"), want: "application/x-mach-binary"},
+		{head: []byte("#!/bin/sh\necho hello\n"), want: "text/x-shellscript"},
+		{head: []byte("%PDF-1.7\n"), want: "application/pdf"},
+		{head: []byte("plain text"), want: "text/plain"},
+		{head: []byte{0x00, 0x01, 0x02, 0x03}, want: genericMIMEType},
+	}
+
+	for _, test := range tests {
+		if got := detectContentType(test.head); got != test.want {
+			t.Errorf("detectContentType(%q) = %q, want %q", test.head, got, test.want)
+		}
+	}
+}
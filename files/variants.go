@@ -0,0 +1,244 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+// maxVariantSourcePixels guards against decompression bombs, larger images are stored without variants
+const maxVariantSourcePixels = 50_000_000
+
+// maxImageHeaderSize bounds what is read to find the dimensions of an image, before deciding to decode it
+const maxImageHeaderSize = 1 << 20
+
+const variantJPEGQuality = 85
+
+var ErrVariantNotFound = eris.New("media variant not found")
+
+// variantFormats maps the image types supported for variant generation to their encoded extension
+var variantFormats = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// variantFilePath returns the path of a variant, derived from the path of the original file so identical originals
+// share their variants when content addressing or hash naming is enabled
+func variantFilePath(originalPath, variant, ext string) string {
+	base := strings.TrimSuffix(originalPath, path.Ext(originalPath))
+	return base + "_" + variant + ext
+}
+
+// plannedVariants returns the names, sorted, and the extension of the variants generated for the file. None are
+// generated for files that aren't a supported photo
+func plannedVariants(fileInfo File) ([]string, string) {
+	sizes := config.GetConfig().FileHandlingConfig.ImageVariants
+	ext, supported := variantFormats[fileInfo.MIMEType]
+	if len(sizes) == 0 || !supported || getDesignatedFolder(fileInfo.MIMEType) != string(MediaCategoryPhotos) {
+		return nil, ""
+	}
+
+	// Generate in a stable order so failures are reproducible
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, ext
+}
+
+// plannedVariantPaths returns the paths the variants of the file are written to by generateVariants
+func plannedVariantPaths(fileInfo File) []string {
+	names, ext := plannedVariants(fileInfo)
+
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, variantFilePath(fileInfo.FilePath, name, ext))
+	}
+
+	return paths
+}
+
+// generateVariants creates the configured image variants of a stored photo and writes them to the file store.
+// Files that aren't a supported image or can't be decoded are left without variants
+func generateVariants(ctx context.Context, fileInfo File) []MediaVariant {
+	names, ext := plannedVariants(fileInfo)
+	if len(names) == 0 {
+		return nil
+	}
+
+	src, err := loadImage(ctx, fileInfo)
+	if err != nil {
+		slog.Warn("unable to generate image variants", "path", fileInfo.FilePath, "reason", err)
+		return nil
+	}
+
+	sizes := config.GetConfig().FileHandlingConfig.ImageVariants
+	variants := make([]MediaVariant, 0, len(names))
+	for _, name := range names {
+		variant, err := storeVariant(ctx, fileInfo, src, name, int(sizes[name]), ext)
+		if err != nil {
+			slog.Warn("unable to generate image variant", "path", fileInfo.FilePath, "variant", name, "reason", err)
+			discardVariants(ctx, variants)
+			return nil
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants
+}
+
+// loadImage decodes an image from the file store. Only its header is read until its dimensions are known to be within
+// maxVariantSourcePixels, the header is then replayed in front of the rest of the file for the full decode
+func loadImage(ctx context.Context, file File) (image.Image, error) {
+	reader, err := OpenFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(io.LimitReader(reader, maxImageHeaderSize), &header))
+	if err != nil {
+		return nil, eris.Wrap(err, "decoding image header")
+	}
+	if cfg.Width*cfg.Height > maxVariantSourcePixels {
+		return nil, eris.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, reader))
+	if err != nil {
+		return nil, eris.Wrap(err, "decoding image")
+	}
+
+	return src, nil
+}
+
+// storeVariant resizes the image so its longest side fits maxDimension, encodes it with the original format and
+// writes it next to the original file
+func storeVariant(ctx context.Context, original File, src image.Image, name string, maxDimension int, ext string) (MediaVariant, error) {
+	resized := resizeImage(src, maxDimension)
+
+	var buf bytes.Buffer
+	var err error
+	switch ext {
+	case ".jpg":
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: variantJPEGQuality})
+	case ".png":
+		err = png.Encode(&buf, resized)
+	case ".gif":
+		err = gif.Encode(&buf, resized, nil)
+	}
+	if err != nil {
+		return MediaVariant{}, eris.Wrap(err, "encoding image variant")
+	}
+
+	hash := sha256.Sum256(buf.Bytes())
+	variant := MediaVariant{
+		Variant: name,
+		Width:   uint(resized.Bounds().Dx()),
+		Height:  uint(resized.Bounds().Dy()),
+		File: File{
+			Filename:  variantFilePath(original.Filename, name, ext),
+			MIMEType:  original.MIMEType,
+			Size:      uint(buf.Len()),
+			FilePath:  variantFilePath(original.FilePath, name, ext),
+			HashValue: hex.EncodeToString(hash[:]),
+
+			// Variants of an encrypted file are encrypted with the same key version
+			EncryptionKeyVersion: original.EncryptionKeyVersion,
+		},
+	}
+
+	content, storedSize, err := sealReader(&buf, int64(buf.Len()), variant.EncryptionKeyVersion)
+	if err != nil {
+		return MediaVariant{}, err
+	}
+
+	if err = GetFileStore().Put(ctx, variant.FilePath, content, storedSize); err != nil {
+		return MediaVariant{}, eris.Wrap(err, "storing image variant")
+	}
+
+	return variant, nil
+}
+
+// discardVariants removes variant files whose database entries could not be saved
+func discardVariants(ctx context.Context, variants []MediaVariant) {
+	for _, variant := range variants {
+		discardUpload(ctx, variant.FilePath)
+	}
+}
+
+// resizeImage downscales the image so its longest side is at most maxDimension while keeping its aspect ratio.
+// Every destination pixel is the average of the source pixels it covers, which gives smooth results when shrinking.
+// Images that already fit are returned as is
+func resizeImage(src image.Image, maxDimension int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if maxDimension <= 0 || (srcW <= maxDimension && srcH <= maxDimension) {
+		return src
+	}
+
+	dstW, dstH := maxDimension, maxDimension
+	if srcW >= srcH {
+		dstH = max(1, srcH*maxDimension/srcW)
+	} else {
+		dstW = max(1, srcW*maxDimension/srcH)
+	}
+
+	// Work on NRGBA for direct pixel access regardless of the decoded type
+	nrgba := image.NewNRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(nrgba, nrgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := y * srcH / dstH
+		y1 := max(y0+1, (y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := x * srcW / dstW
+			x1 := max(x0+1, (x+1)*srcW/dstW)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := nrgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					pixel := nrgba.Pix[offset : offset+4 : offset+4]
+					alpha := uint64(pixel[3])
+					// Weight the colors by their alpha so transparent pixels don't bleed into the average
+					r += uint64(pixel[0]) * alpha
+					g += uint64(pixel[1]) * alpha
+					b += uint64(pixel[2]) * alpha
+					a += alpha
+					count++
+					offset += 4
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[i+0] = uint8(r / a)
+				dst.Pix[i+1] = uint8(g / a)
+				dst.Pix[i+2] = uint8(b / a)
+			}
+			dst.Pix[i+3] = uint8(a / count)
+		}
+	}
+
+	return dst
+}
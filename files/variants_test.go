@@ -0,0 +1,83 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) *LocalStore {
+	t.Helper()
+
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+
+	fileStoreMutex.RLock()
+	previous := fileStore
+	fileStoreMutex.RUnlock()
+
+	SetFileStore(store)
+	t.Cleanup(func() { SetFileStore(previous) })
+
+	return store
+}
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestLoadImage(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	content := encodeTestPNG(t, 40, 30)
+	if err := store.Put(ctx, "photos/a.png", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	src, err := loadImage(ctx, File{FilePath: "photos/a.png", MIMEType: "image/png"})
+	if err != nil {
+		t.Fatalf("loadImage: %v", err)
+	}
+	if bounds := src.Bounds(); bounds.Dx() != 40 || bounds.Dy() != 30 {
+		t.Fatalf("decoded a %dx%d image, want 40x30", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestLoadImageRejectsHugeDimensions(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	// Rewrite the IHDR chunk, right after the 8 bytes signature, to announce a 20000x20000 image
+	content := encodeTestPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(content[16:20], 20000)
+	binary.BigEndian.PutUint32(content[20:24], 20000)
+	binary.BigEndian.PutUint32(content[29:33], crc32.ChecksumIEEE(content[12:29]))
+
+	if err := store.Put(ctx, "photos/huge.png", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, err := loadImage(ctx, File{FilePath: "photos/huge.png", MIMEType: "image/png"})
+	if err == nil || !strings.Contains(err.Error(), "image is too large (20000x20000)") {
+		t.Fatalf("loadImage returned %v, want the too large error", err)
+	}
+}
@@ -5,6 +5,8 @@ go 1.22.1
 require (
 	github.com/go-sql-driver/mysql v1.8.1
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gorm.io/driver/mysql v1.5.7
+	gorm.io/gorm v1.25.11
 )
 
 require (
@@ -17,8 +19,6 @@ require (
 	github.com/stretchr/objx v0.5.2 // indirect
 	golang.org/x/text v0.17.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	gorm.io/driver/mysql v1.5.7 // indirect
-	gorm.io/gorm v1.25.11 // indirect
 )
 
 require (
@@ -0,0 +1,218 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const defaultCheckTimeout = time.Second * 5
+
+// Kind selects the probes a check takes part in
+type Kind int
+
+const (
+	// Liveness checks report whether the process itself works, a failure means it should be restarted.
+	// They are part of both the liveness and the readiness report
+	Liveness Kind = iota
+
+	// Readiness checks report whether a dependency is usable, a failure means no traffic should be sent yet
+	Readiness
+)
+
+func (k Kind) String() string {
+	if k == Liveness {
+		return "liveness"
+	}
+	return "readiness"
+}
+
+// Status is the outcome of a check or of a whole report
+type Status string
+
+const (
+	StatusUp   Status = "up"
+	StatusDown Status = "down"
+)
+
+// CheckFunc reports the health of a dependency, a nil error means it is healthy.
+// It must return once the context is done
+type CheckFunc func(ctx context.Context) error
+
+// CheckResult is the outcome of a single check
+type CheckResult struct {
+	Status    Status  `json:"status"`
+	Kind      string  `json:"kind"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report aggregates the result of every check of a probe, it is up only when every check is up
+type Report struct {
+	Status    Status                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]CheckResult `json:"checks"`
+}
+
+type check struct {
+	kind Kind
+	fn   CheckFunc
+}
+
+var (
+	checks       = make(map[string]check)
+	checksMutex  sync.RWMutex
+	checkTimeout = defaultCheckTimeout
+)
+
+// Register adds a check under name, replacing the one previously registered under the same name
+func Register(name string, kind Kind, fn CheckFunc) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	checks[name] = check{kind: kind, fn: fn}
+}
+
+// Unregister removes the check registered under name, usually once its dependency has been closed
+func Unregister(name string) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	delete(checks, name)
+}
+
+// Registered returns the names of the registered checks in alphabetical order
+func Registered() []string {
+	checksMutex.RLock()
+	defer checksMutex.RUnlock()
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// SetCheckTimeout sets how long a single check may run before it is reported down, default to 5 seconds
+func SetCheckTimeout(timeout time.Duration) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	checkTimeout = timeout
+}
+
+// Check runs the checks of the probe concurrently and aggregates their results. The liveness probe only runs
+// the liveness checks, the readiness probe runs every check
+func Check(ctx context.Context, probe Kind) Report {
+	checksMutex.RLock()
+	selected := make(map[string]check, len(checks))
+	for name, c := range checks {
+		if probe == Readiness || c.kind == Liveness {
+			selected[name] = c
+		}
+	}
+	timeout := checkTimeout
+	checksMutex.RUnlock()
+
+	report := Report{
+		Status:    StatusUp,
+		CheckedAt: time.Now(),
+		Checks:    make(map[string]CheckResult, len(selected)),
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for name, c := range selected {
+		wg.Add(1)
+		go func(name string, c check) {
+			defer wg.Done()
+
+			result := runCheck(ctx, c, timeout)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Checks[name] = result
+			if result.Status == StatusDown {
+				report.Status = StatusDown
+			}
+		}(name, c)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// runCheck runs a single check, a check that panics or outlives its timeout is reported down
+func runCheck(ctx context.Context, c check, timeout time.Duration) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- eris.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- c.fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = eris.Wrap(ctx.Err(), "check did not complete")
+	}
+
+	result := CheckResult{
+		Status:    StatusUp,
+		Kind:      c.kind.String(),
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// Handler serves the report of the probe as JSON, answering 503 when it is down.
+// The probe can be overridden per request with the query parameter "probe=live" or "probe=ready"
+func Handler(probe Kind) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := probe
+		switch r.URL.Query().Get("probe") {
+		case "live":
+			kind = Liveness
+		case "ready":
+			kind = Readiness
+		}
+
+		report := Check(r.Context(), kind)
+
+		status := http.StatusOK
+		if report.Status == StatusDown {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			slog.Error("unable to write health report", "reason", err)
+		}
+	})
+}
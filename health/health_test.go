@@ -0,0 +1,243 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetChecks empties the registry for the duration of the test
+func resetChecks(t *testing.T) {
+	t.Helper()
+
+	checksMutex.Lock()
+	previous, previousTimeout := checks, checkTimeout
+	checks, checkTimeout = make(map[string]check), defaultCheckTimeout
+	checksMutex.Unlock()
+
+	t.Cleanup(func() {
+		checksMutex.Lock()
+		checks, checkTimeout = previous, previousTimeout
+		checksMutex.Unlock()
+	})
+}
+
+func up(context.Context) error { return nil }
+
+func down(context.Context) error { return errors.New("unreachable") }
+
+func TestRegistry(t *testing.T) {
+	resetChecks(t)
+
+	Register("redis", Readiness, up)
+	Register("mariadb", Readiness, up)
+	Register("process", Liveness, up)
+	if got, want := Registered(), []string{"mariadb", "process", "redis"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Registered() = %v, want %v", got, want)
+	}
+
+	// Registering under the same name replaces the check
+	Register("redis", Readiness, down)
+	if result := Check(context.Background(), Readiness).Checks["redis"]; result.Status != StatusDown {
+		t.Fatalf("the replaced check still runs: %+v", result)
+	}
+
+	Unregister("redis")
+	Unregister("unknown")
+	if got, want := Registered(), []string{"mariadb", "process"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Registered() = %v, want %v", got, want)
+	}
+}
+
+func TestCheckAggregation(t *testing.T) {
+	resetChecks(t)
+
+	if report := Check(context.Background(), Readiness); report.Status != StatusUp || len(report.Checks) != 0 {
+		t.Fatalf("report without checks is %+v, want up", report)
+	}
+
+	Register("process", Liveness, up)
+	Register("mariadb", Readiness, up)
+	if report := Check(context.Background(), Readiness); report.Status != StatusUp || len(report.Checks) != 2 {
+		t.Fatalf("report of healthy checks is %+v, want up", report)
+	}
+
+	// A single failing check takes the report down
+	Register("redis", Readiness, down)
+	report := Check(context.Background(), Readiness)
+	if report.Status != StatusDown {
+		t.Fatalf("report is %s with a failing check, want down", report.Status)
+	}
+	if result := report.Checks["redis"]; result.Status != StatusDown || result.Error != "unreachable" || result.Kind != "readiness" {
+		t.Fatalf("failing check reported as %+v", result)
+	}
+	if result := report.Checks["mariadb"]; result.Status != StatusUp || result.Error != "" {
+		t.Fatalf("healthy check reported as %+v", result)
+	}
+
+	// The liveness probe ignores readiness checks
+	report = Check(context.Background(), Liveness)
+	if report.Status != StatusUp || len(report.Checks) != 1 || report.Checks["process"].Kind != "liveness" {
+		t.Fatalf("liveness report is %+v, want only the process check up", report)
+	}
+
+	// A failing liveness check takes both probes down
+	Register("process", Liveness, down)
+	if report = Check(context.Background(), Liveness); report.Status != StatusDown {
+		t.Fatalf("liveness report is %s with a failing liveness check, want down", report.Status)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	resetChecks(t)
+	SetCheckTimeout(time.Millisecond * 100)
+
+	// One check honours the context, the other ignores it
+	Register("slow", Readiness, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	Register("stuck", Readiness, func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	Register("fast", Readiness, up)
+
+	start := time.Now()
+	report := Check(context.Background(), Readiness)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Check took %s with a timeout of 100ms", elapsed)
+	}
+
+	if report.Status != StatusDown {
+		t.Fatalf("report is %s with timed out checks, want down", report.Status)
+	}
+	for _, name := range []string{"slow", "stuck"} {
+		result := report.Checks[name]
+		if result.Status != StatusDown || !strings.Contains(result.Error, "check did not complete") {
+			t.Fatalf("%s check reported as %+v, want a timeout", name, result)
+		}
+		if result.LatencyMs < 100 {
+			t.Fatalf("%s check reported down after %.1fms, before its timeout", name, result.LatencyMs)
+		}
+	}
+	if report.Checks["fast"].Status != StatusUp {
+		t.Fatalf("fast check reported as %+v", report.Checks["fast"])
+	}
+
+	// A zero timeout restores the default
+	SetCheckTimeout(0)
+	if checkTimeout != defaultCheckTimeout {
+		t.Fatalf("timeout is %s, want the default %s", checkTimeout, defaultCheckTimeout)
+	}
+}
+
+func TestCheckRunsConcurrently(t *testing.T) {
+	resetChecks(t)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		Register(name, Readiness, func(context.Context) error {
+			time.Sleep(time.Millisecond * 100)
+			return nil
+		})
+	}
+
+	start := time.Now()
+	if report := Check(context.Background(), Readiness); report.Status != StatusUp {
+		t.Fatalf("report is %+v, want up", report)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*300 {
+		t.Fatalf("Check took %s, the checks didn't run concurrently", elapsed)
+	}
+}
+
+func TestCheckRecoversPanics(t *testing.T) {
+	resetChecks(t)
+
+	Register("panicking", Readiness, func(context.Context) error {
+		panic("boom")
+	})
+	Register("healthy", Readiness, up)
+
+	report := Check(context.Background(), Readiness)
+	if report.Status != StatusDown {
+		t.Fatalf("report is %s with a panicking check, want down", report.Status)
+	}
+	if result := report.Checks["panicking"]; result.Status != StatusDown || !strings.Contains(result.Error, "check panicked: boom") {
+		t.Fatalf("panicking check reported as %+v", result)
+	}
+	if result := report.Checks["healthy"]; result.Status != StatusUp {
+		t.Fatalf("healthy check reported as %+v", result)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	resetChecks(t)
+	Register("process", Liveness, up)
+	Register("redis", Readiness, down)
+
+	tests := []struct {
+		name       string
+		probe      Kind
+		target     string
+		wantStatus int
+		wantChecks []string
+	}{
+		{name: "readiness", probe: Readiness, target: "/health", wantStatus: http.StatusServiceUnavailable, wantChecks: []string{"process", "redis"}},
+		{name: "liveness", probe: Liveness, target: "/health", wantStatus: http.StatusOK, wantChecks: []string{"process"}},
+		{name: "live override", probe: Readiness, target: "/health?probe=live", wantStatus: http.StatusOK, wantChecks: []string{"process"}},
+		{name: "ready override", probe: Liveness, target: "/health?probe=ready", wantStatus: http.StatusServiceUnavailable, wantChecks: []string{"process", "redis"}},
+		{name: "unknown override", probe: Liveness, target: "/health?probe=other", wantStatus: http.StatusOK, wantChecks: []string{"process"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			Handler(test.probe).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status is %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Fatalf("content type is %q", contentType)
+			}
+			if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "no-store" {
+				t.Fatalf("cache control is %q", cacheControl)
+			}
+
+			var report Report
+			if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+				t.Fatalf("decoding report: %v", err)
+			}
+
+			wantStatus := StatusUp
+			if test.wantStatus != http.StatusOK {
+				wantStatus = StatusDown
+			}
+			if report.Status != wantStatus {
+				t.Fatalf("report status is %s, want %s", report.Status, wantStatus)
+			}
+
+			names := make([]string, 0, len(report.Checks))
+			for name := range report.Checks {
+				names = append(names, name)
+			}
+			if len(names) != len(test.wantChecks) {
+				t.Fatalf("report holds %v, want %v", names, test.wantChecks)
+			}
+			for _, name := range test.wantChecks {
+				if _, found := report.Checks[name]; !found {
+					t.Fatalf("report holds %v, want %v", names, test.wantChecks)
+				}
+			}
+		})
+	}
+}
@@ -14,3 +14,9 @@ const (
 	MariaDBErrorsQuery            = MariaDBErrors("Query Results")
 	MariaDBErrorsScanResult       = MariaDBErrors("Scanning Query Rows")
 )
+
+// Names of the checks registered to the health package
+const (
+	HealthCheckMariaDB = "mariadb"
+	HealthCheckRedis   = "redis"
+)
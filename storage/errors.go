@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rotisserie/eris"
+)
+
+// Classes of MariaDB errors, matched with errors.Is against errors returned by WrapMariaDBError
+var (
+	ErrDuplicateKey        = eris.New("duplicate key")
+	ErrForeignKeyViolation = eris.New("foreign key constraint violation")
+	ErrDeadlock            = eris.New("deadlock")
+	ErrLockTimeout         = eris.New("lock wait timeout")
+	ErrConnectionLost      = eris.New("database connection lost")
+	ErrDataTooLong         = eris.New("data too long")
+)
+
+// MariaDB error numbers, see https://mariadb.com/kb/en/mariadb-error-codes/
+const (
+	mariaErrServerShutdown        = 1053
+	mariaErrDuplicateEntry        = 1062
+	mariaErrLockWaitTimeout       = 1205
+	mariaErrDeadlock              = 1213
+	mariaErrNoReferencedRow       = 1216
+	mariaErrRowIsReferenced       = 1217
+	mariaErrDataTooLong           = 1406
+	mariaErrRowIsReferenced2      = 1451
+	mariaErrNoReferencedRow2      = 1452
+	mariaErrDuplicateEntryWithKey = 1586
+	mariaErrConnectionKilled      = 1927
+	mariaErrServerGone            = 2006
+	mariaErrServerLost            = 2013
+)
+
+var mariaErrorClasses = map[uint16]error{
+	mariaErrServerShutdown:        ErrConnectionLost,
+	mariaErrDuplicateEntry:        ErrDuplicateKey,
+	mariaErrLockWaitTimeout:       ErrLockTimeout,
+	mariaErrDeadlock:              ErrDeadlock,
+	mariaErrNoReferencedRow:       ErrForeignKeyViolation,
+	mariaErrRowIsReferenced:       ErrForeignKeyViolation,
+	mariaErrDataTooLong:           ErrDataTooLong,
+	mariaErrRowIsReferenced2:      ErrForeignKeyViolation,
+	mariaErrNoReferencedRow2:      ErrForeignKeyViolation,
+	mariaErrDuplicateEntryWithKey: ErrDuplicateKey,
+	mariaErrConnectionKilled:      ErrConnectionLost,
+	mariaErrServerGone:            ErrConnectionLost,
+	mariaErrServerLost:            ErrConnectionLost,
+}
+
+// MariaDBError is a driver error annotated with the operation that produced it and its class
+type MariaDBError struct {
+	Op MariaDBErrors
+
+	// Kind is one of the Err sentinels of this package, nil when the error isn't classified
+	Kind error
+
+	// Err is the original error, usually a *mysql.MySQLError
+	Err error
+}
+
+func (e *MariaDBError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Unwrap exposes both the class and the original error to errors.Is and errors.As
+func (e *MariaDBError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+// MySQLError returns the server error behind e, nil when the error didn't come from the server
+func (e *MariaDBError) MySQLError() *mysql.MySQLError {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(e.Err, &mysqlErr) {
+		return mysqlErr
+	}
+
+	return nil
+}
+
+// WrapMariaDBError annotates an error returned by the driver with the operation that produced it and classifies it,
+// nil is returned as is
+func WrapMariaDBError(op MariaDBErrors, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &MariaDBError{Op: op, Kind: classifyMariaDBError(err), Err: err}
+}
+
+// classifyMariaDBError returns the Err sentinel matching err, nil when it doesn't match any
+func classifyMariaDBError(err error) error {
+	var mariaErr *MariaDBError
+	if errors.As(err, &mariaErr) && mariaErr.Kind != nil {
+		return mariaErr.Kind
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mariaErrorClasses[mysqlErr.Number]
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return ErrConnectionLost
+	}
+
+	return nil
+}
+
+// HTTPStatusFromMariaDBError maps a MariaDB error to the HTTP status a handler would usually answer with,
+// 500 is returned for errors that aren't classified
+func HTTPStatusFromMariaDBError(err error) int {
+	switch classifyMariaDBError(err) {
+	case ErrDuplicateKey, ErrForeignKeyViolation:
+		return http.StatusConflict
+	case ErrDataTooLong:
+		return http.StatusUnprocessableEntity
+	case ErrDeadlock, ErrLockTimeout, ErrConnectionLost:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rotisserie/eris"
+)
+
+func TestClassifyMariaDBError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantKind   error
+		wantStatus int
+	}{
+		{name: "duplicate entry", err: &mysql.MySQLError{Number: 1062}, wantKind: ErrDuplicateKey, wantStatus: http.StatusConflict},
+		{name: "duplicate entry with key", err: &mysql.MySQLError{Number: 1586}, wantKind: ErrDuplicateKey, wantStatus: http.StatusConflict},
+		{name: "no referenced row", err: &mysql.MySQLError{Number: 1216}, wantKind: ErrForeignKeyViolation, wantStatus: http.StatusConflict},
+		{name: "row is referenced", err: &mysql.MySQLError{Number: 1217}, wantKind: ErrForeignKeyViolation, wantStatus: http.StatusConflict},
+		{name: "row is referenced 2", err: &mysql.MySQLError{Number: 1451}, wantKind: ErrForeignKeyViolation, wantStatus: http.StatusConflict},
+		{name: "no referenced row 2", err: &mysql.MySQLError{Number: 1452}, wantKind: ErrForeignKeyViolation, wantStatus: http.StatusConflict},
+		{name: "data too long", err: &mysql.MySQLError{Number: 1406}, wantKind: ErrDataTooLong, wantStatus: http.StatusUnprocessableEntity},
+		{name: "deadlock", err: &mysql.MySQLError{Number: 1213}, wantKind: ErrDeadlock, wantStatus: http.StatusServiceUnavailable},
+		{name: "lock wait timeout", err: &mysql.MySQLError{Number: 1205}, wantKind: ErrLockTimeout, wantStatus: http.StatusServiceUnavailable},
+		{name: "server shutdown", err: &mysql.MySQLError{Number: 1053}, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+		{name: "connection killed", err: &mysql.MySQLError{Number: 1927}, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+		{name: "server gone", err: &mysql.MySQLError{Number: 2006}, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+		{name: "server lost", err: &mysql.MySQLError{Number: 2013}, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+		{name: "bad connection", err: driver.ErrBadConn, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+		{name: "invalid connection", err: mysql.ErrInvalidConn, wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+
+		// Wrapped errors
+		{name: "fmt wrapped", err: fmt.Errorf("saving media: %w", &mysql.MySQLError{Number: 1062}), wantKind: ErrDuplicateKey, wantStatus: http.StatusConflict},
+		{name: "eris wrapped", err: eris.Wrap(&mysql.MySQLError{Number: 1213}, "saving media"), wantKind: ErrDeadlock, wantStatus: http.StatusServiceUnavailable},
+		{name: "wrapped MariaDBError", err: fmt.Errorf("saving media: %w", WrapMariaDBError(MariaDBErrorsExecStatement, &mysql.MySQLError{Number: 1452})),
+			wantKind: ErrForeignKeyViolation, wantStatus: http.StatusConflict},
+		{name: "joined", err: errors.Join(errors.New("first"), &mysql.MySQLError{Number: 1406}), wantKind: ErrDataTooLong, wantStatus: http.StatusUnprocessableEntity},
+		{name: "wrapped bad connection", err: eris.Wrap(driver.ErrBadConn, "pinging"), wantKind: ErrConnectionLost, wantStatus: http.StatusServiceUnavailable},
+
+		// Unclassified errors
+		{name: "access denied", err: &mysql.MySQLError{Number: 1045}, wantStatus: http.StatusInternalServerError},
+		{name: "syntax error", err: &mysql.MySQLError{Number: 1064}, wantStatus: http.StatusInternalServerError},
+		{name: "no rows", err: sql.ErrNoRows, wantStatus: http.StatusInternalServerError},
+		{name: "other", err: errors.New("other"), wantStatus: http.StatusInternalServerError},
+		{name: "nil", err: nil, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if got := classifyMariaDBError(test.err); got != test.wantKind {
+			t.Errorf("%s: classifyMariaDBError(%v) = %v, want %v", test.name, test.err, got, test.wantKind)
+		}
+		if got := HTTPStatusFromMariaDBError(test.err); got != test.wantStatus {
+			t.Errorf("%s: HTTPStatusFromMariaDBError(%v) = %d, want %d", test.name, test.err, got, test.wantStatus)
+		}
+	}
+}
+
+func TestWrapMariaDBError(t *testing.T) {
+	if WrapMariaDBError(MariaDBErrorsQuery, nil) != nil {
+		t.Fatal("WrapMariaDBError(nil) isn't nil")
+	}
+
+	original := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"}
+	err := fmt.Errorf("saving media: %w", WrapMariaDBError(MariaDBErrorsExecStatement, original))
+
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal("the wrapped error doesn't match its class")
+	}
+	if errors.Is(err, ErrDeadlock) {
+		t.Fatal("the wrapped error matches another class")
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr != original {
+		t.Fatal("the original error isn't reachable with errors.As")
+	}
+
+	var mariaErr *MariaDBError
+	if !errors.As(err, &mariaErr) || mariaErr.Op != MariaDBErrorsExecStatement || mariaErr.MySQLError() != original {
+		t.Fatalf("the MariaDBError isn't reachable with errors.As: %+v", mariaErr)
+	}
+	if want := "Execute Statement: " + original.Error(); mariaErr.Error() != want {
+		t.Fatalf("Error() = %q, want %q", mariaErr.Error(), want)
+	}
+
+	// Unclassified errors only expose the original error
+	unclassified := WrapMariaDBError(MariaDBErrorsQuery, errors.New("other"))
+	if !errors.As(unclassified, &mariaErr) || mariaErr.Kind != nil || mariaErr.MySQLError() != nil {
+		t.Fatalf("unclassified error wrapped as %+v", mariaErr)
+	}
+}
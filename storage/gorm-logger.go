@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+	"gorm.io/gorm"
+	gormLogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+	"gorm.io/gorm/utils"
+)
+
+var gormLogLevels = map[string]gormLogger.LogLevel{
+	"silent": gormLogger.Silent,
+	"error":  gormLogger.Error,
+	"warn":   gormLogger.Warn,
+	"info":   gormLogger.Info,
+}
+
+// slogGormLogger sends the GORM logs through slog instead of GORM's default stdout logger
+type slogGormLogger struct {
+	level         gormLogger.LogLevel
+	slowThreshold time.Duration
+}
+
+var _ gormLogger.Interface = (*slogGormLogger)(nil)
+
+// newGORMConfig builds the GORM config from the GORM settings of the DB config
+func newGORMConfig(config *config.DBConfig) (*gorm.Config, error) {
+	level := gormLogger.Warn
+	if name := strings.ToLower(strings.TrimSpace(config.GORMLogLevel)); name != "" {
+		var found bool
+		if level, found = gormLogLevels[name]; !found {
+			return nil, eris.Errorf("unsupported gorm log level %q", config.GORMLogLevel)
+		}
+	}
+
+	return &gorm.Config{
+		Logger: &slogGormLogger{
+			level:         level,
+			slowThreshold: time.Millisecond * time.Duration(config.GORMSlowThreshold),
+		},
+		PrepareStmt:            config.GORMPrepareStmt,
+		SkipDefaultTransaction: config.GORMSkipDefaultTransaction,
+		DryRun:                 config.GORMDryRun,
+		NamingStrategy: schema.NamingStrategy{
+			TablePrefix:   config.GORMTablePrefix,
+			SingularTable: config.GORMSingularTable,
+		},
+	}, nil
+}
+
+func (l *slogGormLogger) LogMode(level gormLogger.LogLevel) gormLogger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *slogGormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormLogger.Info {
+		slog.InfoContext(ctx, fmt.Sprintf(msg, args...), "caller", utils.FileWithLineNum())
+	}
+}
+
+func (l *slogGormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormLogger.Warn {
+		slog.WarnContext(ctx, fmt.Sprintf(msg, args...), "caller", utils.FileWithLineNum())
+	}
+}
+
+func (l *slogGormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormLogger.Error {
+		slog.ErrorContext(ctx, fmt.Sprintf(msg, args...), "caller", utils.FileWithLineNum())
+	}
+}
+
+// Trace logs failed queries at the error level, slow queries at the warn level and every query at the info level.
+// A record not found error is expected by callers and isn't logged as a failure. Failed and slow queries are logged
+// by fingerprint so their values stay out of the logs, the info level logs the full SQL for debugging
+func (l *slogGormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= gormLogger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && l.level >= gormLogger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		slog.ErrorContext(ctx, "gorm query failed",
+			"fingerprint", fingerprintQuery(sql), "rows", rows, "elapsed", elapsed, "caller", utils.FileWithLineNum(), "reason", err)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= gormLogger.Warn:
+		sql, rows := fc()
+		slog.WarnContext(ctx, "slow gorm query",
+			"fingerprint", fingerprintQuery(sql), "rows", rows, "elapsed", elapsed, "threshold", l.slowThreshold, "caller", utils.FileWithLineNum())
+	case l.level >= gormLogger.Info:
+		sql, rows := fc()
+		slog.InfoContext(ctx, "gorm query",
+			"sql", sql, "rows", rows, "elapsed", elapsed, "caller", utils.FileWithLineNum())
+	}
+}
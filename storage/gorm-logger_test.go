@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	gormLogger "gorm.io/gorm/logger"
+)
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return &buf
+}
+
+func TestGORMLoggerKeepsValuesOutOfLogs(t *testing.T) {
+	logger := &slogGormLogger{level: gormLogger.Warn, slowThreshold: time.Millisecond}
+	query := func() (string, int64) {
+		return "SELECT * FROM `users` WHERE email = 'john@example.com' AND id IN (1,2,3)", 1
+	}
+	const fingerprint = "SELECT * FROM `users` WHERE email = ? AND id IN (?+)"
+
+	tests := []struct {
+		name    string
+		begin   time.Time
+		err     error
+		message string
+	}{
+		{name: "failed", begin: time.Now(), err: errors.New("boom"), message: "gorm query failed"},
+		{name: "slow", begin: time.Now().Add(-time.Second), message: "slow gorm query"},
+	}
+
+	for _, test := range tests {
+		logs := captureLogs(t)
+		logger.Trace(context.Background(), test.begin, query, test.err)
+
+		output := logs.String()
+		if !strings.Contains(output, test.message) || !strings.Contains(output, fingerprint) {
+			t.Errorf("%s: the query isn't logged by fingerprint: %s", test.name, output)
+		}
+		if strings.Contains(output, "john@example.com") {
+			t.Errorf("%s: the values of the query are logged: %s", test.name, output)
+		}
+	}
+
+	// Fast queries and missing records are not logged below the info level
+	logs := captureLogs(t)
+	logger.Trace(context.Background(), time.Now(), query, nil)
+	logger.Trace(context.Background(), time.Now(), query, gorm.ErrRecordNotFound)
+	if logs.Len() != 0 {
+		t.Errorf("unexpected logs: %s", logs)
+	}
+}
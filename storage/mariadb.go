@@ -1,29 +1,56 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/rotisserie/eris"
 	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/voxtmault/panacea-shared-lib/health"
 	gormMysql "gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
 var (
-	mariaCon     *sql.DB
-	gormMariaCon *gorm.DB
+	ErrMariaDBNotInitialized     = eris.New("mariadb connection has not been initialized")
+	ErrMariaDBAlreadyInitialized = eris.New("mariadb connection is already initialized, call Close first")
 )
 
+// defaultMariaDB is the client behind the package level functions, set by InitMariaDB
+var defaultMariaDB atomic.Pointer[MariaDB]
+
+// MariaDatabaseStats is a snapshot of the connection pool statistics, counters are totals since the pool was opened
 type MariaDatabaseStats struct {
+	MaxOpenConnections   int           `json:"max_open_connections"`
 	OpenConnections      int           `json:"open_connections"`
 	ConnectionInUse      int           `json:"connection_in_use"`
 	ConnectionIdle       int           `json:"connection_idle"`
 	WaitingForConnection int           `json:"waiting_for_connection"`
 	TotalWaitTime        time.Duration `json:"total_wait_time"`
+
+	// Connections closed because of MaxIdleConns, ConnMaxIdleTime and ConnMaxLifetime
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+// MariaDB is a client of a MariaDB server holding its own connection pool, read replicas and GORM connections.
+// A service talking to several databases creates one per database with NewMariaDB
+type MariaDB struct {
+	config   config.DBConfig
+	db       *sql.DB
+	router   *DBRouter
+	tracer   *QueryTracer
+	monitor  *connectionMonitor
+	gorm     *gorm.DB
+	gormRead *gorm.DB
 }
 
 func validateMariaDBConfig(config *config.DBConfig) error {
@@ -39,94 +66,365 @@ func validateMariaDBConfig(config *config.DBConfig) error {
 	if config.DBName == "" {
 		return eris.New("invalid db name")
 	}
+	if config.MaxOpenConns > 0 && config.MaxIdleConns > config.MaxOpenConns {
+		return eris.Errorf("db max idle connections (%d) exceeds max open connections (%d)", config.MaxIdleConns, config.MaxOpenConns)
+	}
+	if config.ConnMaxLifetime > 0 && config.ConnMaxIdleTime > config.ConnMaxLifetime {
+		return eris.Errorf("db connection max idle time (%ds) exceeds max lifetime (%ds)", config.ConnMaxIdleTime, config.ConnMaxLifetime)
+	}
+	if config.MaxIdleConns == 0 && config.ConnMaxIdleTime > 0 {
+		return eris.New("db connection max idle time is set but no idle connection is kept")
+	}
+	if _, found := gormLogLevels[strings.ToLower(strings.TrimSpace(config.GORMLogLevel))]; !found && strings.TrimSpace(config.GORMLogLevel) != "" {
+		return eris.Errorf("unsupported gorm log level %q", config.GORMLogLevel)
+	}
 
 	return nil
 }
 
-// InitMaria Establish a connection using the provided credentials with the mariadb service
+// NewMariaDB opens and verifies a connection to the MariaDB server of the config, along with its read replicas.
+// It waits for up to StartupTimeout for the server to become reachable
+func NewMariaDB(config *config.DBConfig) (*MariaDB, error) {
+	if err := validateMariaDBConfig(config); err != nil {
+		return nil, eris.Wrap(err, "invalid MariaDB configuration")
+	}
+
+	var tracer *QueryTracer
+	if config.QueryTracing {
+		tracer = NewQueryTracer(time.Millisecond * time.Duration(config.SlowQueryThreshold))
+	}
+
+	addr := fmt.Sprintf("%s:%s", config.DBHost, config.DBPort)
+	db, err := openMariaDB(config, addr, tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retryStartup(HealthCheckMariaDB,
+		time.Second*time.Duration(config.StartupTimeout),
+		time.Millisecond*time.Duration(config.StartupRetryInterval),
+		db.PingContext,
+	)
+	if err != nil {
+		db.Close()
+		return nil, eris.Wrap(err, "Error verifying database connection")
+	}
+
+	m := &MariaDB{config: *config, db: db, tracer: tracer}
+	if len(config.ReplicaHosts) > 0 {
+		if m.router, err = newDBRouter(config, db, tracer); err != nil {
+			db.Close()
+			return nil, eris.Wrap(err, "Opening replica connections")
+		}
+	}
+
+	m.monitor = startConnectionMonitor(HealthCheckMariaDB, addr, time.Second*time.Duration(config.MonitorInterval), m.Ping)
+
+	return m, nil
+}
+
+// InitMaria Establish a connection using the provided credentials with the mariadb service. It fails while a default
+// client is set, Close it first to reconnect
 func InitMariaDB(config *config.DBConfig) error {
+	if defaultMariaDB.Load() != nil {
+		return ErrMariaDBAlreadyInitialized
+	}
+
 	log.Println("Opening Connection to Database")
-	var err error
 
-	// Validation
-	if err := validateMariaDBConfig(config); err != nil {
-		return eris.Wrap(err, "invalid MariaDB configuration")
+	m, err := NewMariaDB(config)
+	if err != nil {
+		return err
+	}
+	if !defaultMariaDB.CompareAndSwap(nil, m) {
+		m.Close()
+		return ErrMariaDBAlreadyInitialized
 	}
 
+	health.Register(HealthCheckMariaDB, health.Readiness, pingMariaDB)
+
+	log.Println("Successfully opened database connection !")
+	return nil
+}
+
+// SetDefaultMariaDB replaces the client used by the package level functions, the caller stays in charge of closing
+// the previous one
+func SetDefaultMariaDB(m *MariaDB) {
+	defaultMariaDB.Store(m)
+}
+
+// GetDefaultMariaDB returns the client used by the package level functions, nil until InitMariaDB succeeds and
+// after Close
+func GetDefaultMariaDB() *MariaDB {
+	return defaultMariaDB.Load()
+}
+
+// pingMariaDB is the health check of the primary, replicas are left out since reads fall back to the primary
+func pingMariaDB(ctx context.Context) error {
+	return defaultMariaDB.Load().Ping(ctx)
+}
+
+// openMariaDB opens a connection pool to the server on addr using the credentials and pool settings of the config,
+// its statements go through the traced driver when tracer isn't nil
+func openMariaDB(config *config.DBConfig, addr string, tracer *QueryTracer) (*sql.DB, error) {
 	dsn := mysql.Config{
 		User:                 config.DBUser,
 		Passwd:               config.DBPassword,
 		AllowNativePasswords: config.AllowNativePasswords,
 		Net:                  "tcp",
-		Addr:                 fmt.Sprintf("%s:%s", config.DBHost, config.DBPort),
+		Addr:                 addr,
 		DBName:               config.DBName,
 		TLSConfig:            config.TSLConfig,
 		MultiStatements:      config.MultiStatements,
+		Timeout:              time.Second * time.Duration(config.ConnectTimeout),
+		ReadTimeout:          time.Second * time.Duration(config.ReadTimeout),
+		WriteTimeout:         time.Second * time.Duration(config.WriteTimeout),
 		Params: map[string]string{
 			"charset": "utf8",
 		},
 	}
 
-	mariaCon, err = sql.Open(mariaDriver, dsn.FormatDSN())
-	if err != nil {
-		return eris.Wrap(err, "Opening MySQL/MariaDB Connection")
+	var db *sql.DB
+	if tracer != nil {
+		connector, err := mysql.NewConnector(&dsn)
+		if err != nil {
+			return nil, eris.Wrap(err, "Opening MySQL/MariaDB Connection")
+		}
+		db = sql.OpenDB(newTracedConnector(connector, tracer))
+	} else {
+		var err error
+		if db, err = sql.Open(mariaDriver, dsn.FormatDSN()); err != nil {
+			return nil, eris.Wrap(err, "Opening MySQL/MariaDB Connection")
+		}
 	}
 
-	mariaCon.SetMaxOpenConns(20)
-	mariaCon.SetMaxIdleConns(5)
-	mariaCon.SetConnMaxLifetime(time.Second * 5)
+	db.SetMaxOpenConns(int(config.MaxOpenConns))
+	db.SetMaxIdleConns(int(config.MaxIdleConns))
+	db.SetConnMaxLifetime(time.Second * time.Duration(config.ConnMaxLifetime))
+	db.SetConnMaxIdleTime(time.Second * time.Duration(config.ConnMaxIdleTime))
+
+	return db, nil
+}
+
+// DB returns the connection pool of the primary, nil when m is nil
+func (m *MariaDB) DB() *sql.DB {
+	if m == nil {
+		return nil
+	}
+	return m.db
+}
+
+// Config returns a copy of the config the client was created with
+func (m *MariaDB) Config() config.DBConfig {
+	if m == nil {
+		return config.DBConfig{}
+	}
+	return m.config
+}
+
+// Router returns the router of the client, nil when no replica is configured
+func (m *MariaDB) Router() *DBRouter {
+	if m == nil {
+		return nil
+	}
+	return m.router
+}
+
+// ReadDB returns a healthy read replica, falling back to the primary when none is available or
+// no replica is configured. Only use it for reads that can tolerate the replication lag
+func (m *MariaDB) ReadDB() *sql.DB {
+	if m == nil {
+		return nil
+	}
+	if m.router == nil {
+		return m.db
+	}
+
+	return m.router.Reader()
+}
+
+// Ping verifies the connection to the primary
+func (m *MariaDB) Ping(ctx context.Context) error {
+	if m == nil || m.db == nil {
+		return ErrMariaDBNotInitialized
+	}
+
+	if err := m.db.PingContext(ctx); err != nil {
+		return WrapMariaDBError(MariaDBErrorsQuery, err)
+	}
+
+	return nil
+}
 
-	err = mariaCon.Ping()
+// State returns the state of the primary last seen by the connection monitor, unknown when it is disabled
+func (m *MariaDB) State() ConnectionState {
+	if m == nil {
+		return ConnectionStateUnknown
+	}
+	return m.monitor.State()
+}
+
+// Stats returns the statistics of the primary connection pool, zero when m is nil
+func (m *MariaDB) Stats() MariaDatabaseStats {
+	if m == nil || m.db == nil {
+		return MariaDatabaseStats{}
+	}
+
+	return newMariaDatabaseStats(m.db.Stats())
+}
+
+// newMariaDatabaseStats converts a single sql.DBStats snapshot, so every field is taken at the same time
+func newMariaDatabaseStats(stats sql.DBStats) MariaDatabaseStats {
+	return MariaDatabaseStats{
+		MaxOpenConnections:   stats.MaxOpenConnections,
+		OpenConnections:      stats.OpenConnections,
+		ConnectionInUse:      stats.InUse,
+		ConnectionIdle:       stats.Idle,
+		WaitingForConnection: int(stats.WaitCount),
+		TotalWaitTime:        stats.WaitDuration,
+		MaxIdleClosed:        stats.MaxIdleClosed,
+		MaxIdleTimeClosed:    stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:    stats.MaxLifetimeClosed,
+	}
+}
+
+// QueryTracer returns the tracer recording the statements of the client, nil when QueryTracing is disabled
+func (m *MariaDB) QueryTracer() *QueryTracer {
+	if m == nil {
+		return nil
+	}
+	return m.tracer
+}
+
+// QueryStats returns the statistics of the statements of the client per query fingerprint, the most time
+// consuming first. Empty when QueryTracing is disabled
+func (m *MariaDB) QueryStats() []QueryStats {
+	return m.QueryTracer().Stats()
+}
+
+// Close stops the connection monitor and closes the read replicas and the primary connection pool, calling it again
+// is a no-op
+func (m *MariaDB) Close() error {
+	if m == nil || m.db == nil {
+		return nil
+	}
+
+	m.monitor.Close()
+
+	if m.router != nil {
+		if err := m.router.Close(); err != nil {
+			slog.Error("unable to close read replicas", "reason", err)
+		}
+	}
+
+	if err := m.db.Close(); err != nil {
+		return eris.Wrap(err, "Closing DB")
+	}
+
+	return nil
+}
+
+// InitGORM opens the GORM connections of the client on top of its connection pool, configured by the GORM
+// settings of the client config
+func (m *MariaDB) InitGORM() error {
+	if m == nil || m.db == nil {
+		return ErrMariaDBNotInitialized
+	}
+
+	conn, err := m.openGORM(m.db)
 	if err != nil {
-		return eris.Wrap(err, "Error verifying database connection")
+		return eris.Wrap(err, "Opening GORM connection")
+	}
+	m.gorm = conn
+
+	// Reads of the read connection go through the router, writes and transactions still reach the primary
+	if m.router != nil {
+		readConn, err := m.openGORM(m.router)
+		if err != nil {
+			return eris.Wrap(err, "Opening GORM read connection")
+		}
+		m.gormRead = readConn
 	}
 
-	log.Println("Successfully opened database connection !")
 	return nil
 }
 
+// openGORM opens a GORM connection over pool, each connection needs its own config since GORM keeps its state there
+func (m *MariaDB) openGORM(pool gorm.ConnPool) (*gorm.DB, error) {
+	gormConfig, err := newGORMConfig(&m.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return gorm.Open(
+		gormMysql.New(gormMysql.Config{
+			Conn: pool,
+		}),
+		gormConfig,
+	)
+}
+
+// GORM returns the GORM connection of the client, nil until InitGORM succeeds
+func (m *MariaDB) GORM() *gorm.DB {
+	if m == nil {
+		return nil
+	}
+	return m.gorm
+}
+
+// GORMRead returns a GORM connection whose reads are sent to healthy read replicas, it is the primary
+// connection when no replica is configured. Only use it for reads that can tolerate the replication lag.
+// With GORMPrepareStmt every statement is prepared on the primary, so the reads are not sent to the replicas
+func (m *MariaDB) GORMRead() *gorm.DB {
+	if m == nil {
+		return nil
+	}
+	if m.gormRead == nil {
+		return m.gorm
+	}
+
+	return m.gormRead
+}
+
 func GetDBConnection() *sql.DB {
-	return mariaCon
+	return defaultMariaDB.Load().DB()
 }
 
-// GetMariaStats
+// GetMariaStats returns the statistics of the default connection pool, zero when InitMariaDB hasn't run
 func GetDBStats() MariaDatabaseStats {
-	return MariaDatabaseStats{
-		OpenConnections:      mariaCon.Stats().OpenConnections,
-		ConnectionInUse:      mariaCon.Stats().InUse,
-		ConnectionIdle:       mariaCon.Stats().Idle,
-		WaitingForConnection: int(mariaCon.Stats().WaitCount),
-		TotalWaitTime:        mariaCon.Stats().WaitDuration,
-	}
+	return defaultMariaDB.Load().Stats()
+}
+
+// GetQueryStats returns the statistics of the statements of the default client per query fingerprint
+func GetQueryStats() []QueryStats {
+	return defaultMariaDB.Load().QueryStats()
 }
 
 // CloseMaria will close the current database connection, only do this when exiting the program
 //
 // Under normal circumstances, this shouldn't be called by anyone other than main
 func Close() error {
-	if err := mariaCon.Close(); err != nil {
-		return eris.Wrap(err, "Closing DB")
-	} else {
-		return nil
-	}
+	health.Unregister(HealthCheckMariaDB)
+
+	return defaultMariaDB.Swap(nil).Close()
 }
 
-// ORM Implementation
+// ORM Implementation, InitMariaDB must have run before
 func InitGORMMariaDB() error {
-	conn, err := gorm.Open(
-		gormMysql.New(gormMysql.Config{
-			Conn: mariaCon,
-		}),
-		&gorm.Config{},
-	)
-	if err != nil {
-		return err
+	m := defaultMariaDB.Load()
+	if m == nil {
+		return eris.Wrap(ErrMariaDBNotInitialized, "InitMariaDB must be called before InitGORMMariaDB")
 	}
-	gormMariaCon = conn
 
-	return nil
+	return m.InitGORM()
 }
 
 func GetGORMMariaDB() *gorm.DB {
-	return gormMariaCon
+	return defaultMariaDB.Load().GORM()
+}
+
+// GetGORMReadDB returns a GORM connection whose reads are sent to healthy read replicas, it is the primary
+// connection when no replica is configured. Only use it for reads that can tolerate the replication lag
+func GetGORMReadDB() *gorm.DB {
+	return defaultMariaDB.Load().GORMRead()
 }
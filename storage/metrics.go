@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsHandler serves the pool statistics of the default MariaDB and Redis clients in the Prometheus text format.
+// The clients are looked up on every request, those not initialized are left out
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, defaultMariaDB.Load(), defaultRedis.Load())
+	})
+}
+
+// NewMetricsHandler serves the pool statistics of the given clients in the Prometheus text format, a nil client is
+// left out
+func NewMetricsHandler(db *MariaDB, rds *Redis) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, db, rds)
+	})
+}
+
+func serveMetrics(w http.ResponseWriter, db *MariaDB, rds *Redis) {
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := WriteMetrics(w, db, rds); err != nil {
+		slog.Error("unable to write storage metrics", "reason", err)
+	}
+}
+
+// WriteMetrics writes the pool statistics of the given clients in the Prometheus text format, a nil client is left out
+func WriteMetrics(w io.Writer, db *MariaDB, rds *Redis) error {
+	buffered := bufio.NewWriter(w)
+	metrics := metricsWriter{w: buffered}
+
+	if db.DB() != nil {
+		stats := db.Stats()
+		metrics.write("mariadb_pool_max_open_connections", "gauge", "Maximum number of open connections, 0 is unlimited", stats.MaxOpenConnections)
+		metrics.write("mariadb_pool_open_connections", "gauge", "Number of open connections", stats.OpenConnections)
+		metrics.write("mariadb_pool_in_use_connections", "gauge", "Number of connections in use", stats.ConnectionInUse)
+		metrics.write("mariadb_pool_idle_connections", "gauge", "Number of idle connections", stats.ConnectionIdle)
+		metrics.write("mariadb_pool_wait_count_total", "counter", "Number of times a connection was waited for", stats.WaitingForConnection)
+		metrics.write("mariadb_pool_wait_duration_seconds_total", "counter", "Time spent waiting for a connection", stats.TotalWaitTime.Seconds())
+		metrics.write("mariadb_pool_max_idle_closed_total", "counter", "Connections closed because of MaxIdleConns", stats.MaxIdleClosed)
+		metrics.write("mariadb_pool_max_idle_time_closed_total", "counter", "Connections closed because of ConnMaxIdleTime", stats.MaxIdleTimeClosed)
+		metrics.write("mariadb_pool_max_lifetime_closed_total", "counter", "Connections closed because of ConnMaxLifetime", stats.MaxLifetimeClosed)
+	}
+
+	if rds.Client() != nil {
+		stats := rds.Stats()
+		metrics.write("redis_pool_hits_total", "counter", "Number of times a free connection was found in the pool", stats.Hits)
+		metrics.write("redis_pool_misses_total", "counter", "Number of times a free connection was not found in the pool", stats.Misses)
+		metrics.write("redis_pool_timeouts_total", "counter", "Number of times waiting for a connection timed out", stats.Timeouts)
+		metrics.write("redis_pool_total_connections", "gauge", "Number of connections in the pool", stats.TotalConnections)
+		metrics.write("redis_pool_idle_connections", "gauge", "Number of idle connections in the pool", stats.IdleConnections)
+		metrics.write("redis_pool_stale_connections_total", "counter", "Number of stale connections removed from the pool", stats.StaleConnections)
+	}
+
+	if metrics.err != nil {
+		return metrics.err
+	}
+
+	return buffered.Flush()
+}
+
+// metricsWriter keeps the first write error so the metrics can be written without checking every line
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricsWriter) write(name, kind, help string, value any) {
+	if m.err != nil {
+		return
+	}
+
+	_, m.err = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
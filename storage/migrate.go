@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	defaultMigrationTable       = "schema_migrations"
+	defaultMigrationLockTimeout = time.Minute
+)
+
+var (
+	ErrMigrationLocked  = eris.New("another instance is running the migrations")
+	ErrMigrationMissing = eris.New("migration file not found")
+)
+
+// migrationFilePattern matches <version>_<name>.up.sql and <version>_<name>.down.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var migrationTablePattern = regexp.MustCompile(`^\w+$`)
+
+// delimiterCommandPattern matches the DELIMITER client command, which changes the statement delimiter of a script
+var delimiterCommandPattern = regexp.MustCompile(`(?i)^DELIMITER[ \t]+(\S+)[ \t]*(\r?\n|$)`)
+
+// Migration is a versioned schema change read from the migration files
+type Migration struct {
+	Version uint64 `json:"version"`
+	Name    string `json:"name"`
+	Up      string `json:"-"`
+	Down    string `json:"-"`
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Version   uint64     `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+
+	// Missing is set for applied versions whose files are no longer shipped
+	Missing bool `json:"missing,omitempty"`
+}
+
+// MigrateOptions customizes a Migrator
+type MigrateOptions struct {
+	// Table recording the applied versions, default to schema_migrations
+	Table string
+
+	// LockTimeout is how long to wait for another instance to finish migrating, default to 1 minute
+	LockTimeout time.Duration
+
+	// DryRun logs the statements that would run without executing them
+	DryRun bool
+}
+
+// Migrator applies the SQL migrations of a directory, usually embedded with embed.FS.
+//
+// Files are named <version>_<name>.up.sql and <version>_<name>.down.sql and run in ascending version order, each one
+// in its own transaction. Keep in mind that MariaDB commits DDL statements implicitly, so a migration mixing DDL
+// statements can't be fully rolled back when one of them fails
+type Migrator struct {
+	db         *sql.DB
+	opts       MigrateOptions
+	migrations []Migration
+}
+
+// NewMigrator reads the migrations of dir within fsys. The MariaDB connection is used when db is nil
+func NewMigrator(db *sql.DB, fsys fs.FS, dir string, opts MigrateOptions) (*Migrator, error) {
+	if db == nil {
+		db = GetDBConnection()
+	}
+	if db == nil {
+		return nil, ErrMariaDBNotInitialized
+	}
+
+	if opts.Table == "" {
+		opts.Table = defaultMigrationTable
+	}
+	if !migrationTablePattern.MatchString(opts.Table) {
+		return nil, eris.Errorf("invalid migration table name %q", opts.Table)
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = defaultMigrationLockTimeout
+	}
+
+	migrations, err := readMigrations(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, opts: opts, migrations: migrations}, nil
+}
+
+// readMigrations parses the migration files of dir, sorted by version
+func readMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading migration directory")
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, eris.Wrapf(err, "parsing version of %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, eris.Wrapf(err, "reading %s", entry.Name())
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, eris.Errorf("migration version %d is used by both %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if strings.TrimSpace(migration.Up) == "" {
+			return nil, eris.Errorf("migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrations returns every known migration sorted by version
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Status reports which migrations have been applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.appliedVersions(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	known := make(map[uint64]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	for version, record := range applied {
+		if !known[version] {
+			statuses = append(statuses, MigrationStatus{
+				Version:   version,
+				Name:      record.Name,
+				Applied:   true,
+				AppliedAt: &record.AppliedAt,
+				Missing:   true,
+			})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// Up applies every pending migration and returns them, in dry run mode they are only logged
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			if err = m.run(ctx, conn, migration, migration.Up, true); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns them. In dry run mode they are only logged
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]uint64, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		if steps < len(versions) {
+			versions = versions[:max(steps, 0)]
+		}
+
+		// Check every file first so a missing one doesn't leave the schema half reverted
+		targets := make([]Migration, 0, len(versions))
+		for _, version := range versions {
+			migration, found := m.find(version)
+			if !found || strings.TrimSpace(migration.Down) == "" {
+				return eris.Wrapf(ErrMigrationMissing, "down migration of version %d", version)
+			}
+			targets = append(targets, migration)
+		}
+
+		for _, migration := range targets {
+			if err = m.run(ctx, conn, migration, migration.Down, false); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func (m *Migrator) find(version uint64) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+
+	return Migration{}, false
+}
+
+// locked runs fn on a dedicated connection holding the migration advisory lock. GET_LOCK is bound to the connection,
+// so every statement of the run must go through it
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return eris.Wrap(err, "getting migration connection")
+	}
+	defer conn.Close()
+
+	// Lock names are server wide, the database name keeps services sharing a server apart
+	var lockName string
+	if err = conn.QueryRowContext(ctx, "SELECT CONCAT(COALESCE(DATABASE(), ''), '.', ?)", m.opts.Table).Scan(&lockName); err != nil {
+		return WrapMariaDBError(MariaDBErrorsQueryRow, err)
+	}
+
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(m.opts.LockTimeout.Seconds())).Scan(&acquired)
+	if err != nil {
+		return WrapMariaDBError(MariaDBErrorsQueryRow, err)
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		return ErrMigrationLocked
+	}
+
+	defer func() {
+		// The request context may already be cancelled at this point
+		if _, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName); err != nil {
+			slog.Warn("unable to release the migration lock", "lock", lockName, "reason", err)
+		}
+	}()
+
+	if !m.opts.DryRun {
+		if err = m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"version BIGINT UNSIGNED NOT NULL PRIMARY KEY, "+
+		"name VARCHAR(255) NOT NULL, "+
+		"applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP"+
+		")", m.opts.Table)
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return WrapMariaDBError(MariaDBErrorsExecStatement, err)
+	}
+
+	return nil
+}
+
+type appliedMigration struct {
+	Name      string
+	AppliedAt time.Time
+}
+
+// queryer is implemented by both *sql.DB and *sql.Conn
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// appliedVersions returns the recorded versions, none when the table doesn't exist yet
+func (m *Migrator) appliedVersions(ctx context.Context, db queryer) (map[uint64]appliedMigration, error) {
+	var tables int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+		m.opts.Table,
+	).Scan(&tables)
+	if err != nil {
+		return nil, WrapMariaDBError(MariaDBErrorsQueryRow, err)
+	}
+
+	applied := make(map[uint64]appliedMigration)
+	if tables == 0 {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version, name, applied_at FROM `%s`", m.opts.Table))
+	if err != nil {
+		return nil, WrapMariaDBError(MariaDBErrorsQuery, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version uint64
+		var record appliedMigration
+		var appliedAt any
+		if err = rows.Scan(&version, &record.Name, &appliedAt); err != nil {
+			return nil, WrapMariaDBError(MariaDBErrorsScanResult, err)
+		}
+
+		// DATETIME columns are only returned as time.Time when the DSN sets parseTime
+		switch value := appliedAt.(type) {
+		case time.Time:
+			record.AppliedAt = value
+		case []byte:
+			record.AppliedAt, _ = time.Parse(time.DateTime, string(value))
+		}
+		applied[version] = record
+	}
+	if err = rows.Err(); err != nil {
+		return nil, WrapMariaDBError(MariaDBErrorsQuery, err)
+	}
+
+	return applied, nil
+}
+
+// run executes the statements of one migration and records it, inside a single transaction
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, script string, up bool) error {
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+	statements := splitSQLStatements(script)
+
+	if m.opts.DryRun {
+		for _, statement := range statements {
+			slog.Info("dry run migration statement", "version", migration.Version, "name", migration.Name, "direction", direction, "statement", statement)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return WrapMariaDBError(MariaDBErrorsBeginTx, err)
+	}
+
+	fail := func(err error) error {
+		tx.Rollback()
+		return eris.Wrapf(err, "migration %d_%s %s", migration.Version, migration.Name, direction)
+	}
+
+	for _, statement := range statements {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			return fail(WrapMariaDBError(MariaDBErrorsExecStatement, err))
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO `%s` (version, name) VALUES (?, ?)", m.opts.Table), migration.Version, migration.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM `%s` WHERE version = ?", m.opts.Table), migration.Version)
+	}
+	if err != nil {
+		return fail(WrapMariaDBError(MariaDBErrorsExecStatement, err))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(WrapMariaDBError(MariaDBErrorsCommitTx, err))
+	}
+
+	slog.Info("migration applied", "version", migration.Version, "name", migration.Name, "direction", direction, "elapsed", time.Since(start))
+	return nil
+}
+
+// splitSQLStatements splits a script on the semicolons that aren't inside a string, an identifier or a comment,
+// so migrations don't depend on the MultiStatements setting. Comments are dropped except the /*! and /*M! executable
+// comments. A DELIMITER line replaces the semicolon until the next one, for routines and triggers whose body holds
+// semicolons
+func splitSQLStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	delimiter := ";"
+
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+
+		// DELIMITER is only a command at the start of a statement
+		if (c == 'D' || c == 'd') && strings.TrimSpace(current.String()) == "" {
+			if match := delimiterCommandPattern.FindStringSubmatch(script[i:]); match != nil {
+				delimiter = match[1]
+				current.Reset()
+				i += len(match[0]) - 1
+				continue
+			}
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Copy the quoted part as is, a backslash escapes the next character except inside identifiers
+			end := i + 1
+			for end < len(script) && script[end] != c {
+				if script[end] == '\\' && c != '`' {
+					end++
+				}
+				end++
+			}
+			end = min(end, len(script)-1)
+			current.WriteString(script[i : end+1])
+			i = end
+		case c == '#', c == '-' && isLineComment(script[i:]):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+				current.WriteByte('\n')
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script)
+			} else {
+				end += i + 4
+			}
+			// Executable comments are run by the server, they are kept as is
+			if isExecutableComment(script[i:]) {
+				current.WriteString(script[i:end])
+			} else {
+				current.WriteByte(' ')
+			}
+			i = end - 1
+		case strings.HasPrefix(script[i:], delimiter):
+			flush()
+			i += len(delimiter) - 1
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// isExecutableComment reports whether s starts with a /*! or /*M! comment, whose content is executed by the server
+func isExecutableComment(s string) bool {
+	return strings.HasPrefix(s, "/*!") || strings.HasPrefix(s, "/*M!")
+}
+
+// isLineComment reports whether s starts with a -- comment, which must be followed by a whitespace
+func isLineComment(s string) bool {
+	return strings.HasPrefix(s, "--") && (len(s) == 2 || strings.ContainsRune(" \t\r\n", rune(s[2])))
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "single statement",
+			script: "CREATE TABLE a (id INT)",
+			want:   []string{"CREATE TABLE a (id INT)"},
+		},
+		{
+			name:   "several statements",
+			script: "CREATE TABLE a (id INT);\n\nINSERT INTO a VALUES (1);\n",
+			want:   []string{"CREATE TABLE a (id INT)", "INSERT INTO a VALUES (1)"},
+		},
+		{
+			name:   "empty statements",
+			script: " ;\n;; SELECT 1 ;; ",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "quoted semicolons",
+			script: "INSERT INTO a VALUES ('x;y', \"z;w\");SELECT `odd;name` FROM a",
+			want:   []string{"INSERT INTO a VALUES ('x;y', \"z;w\")", "SELECT `odd;name` FROM a"},
+		},
+		{
+			name:   "escaped quotes",
+			script: `INSERT INTO a VALUES ('it\'s;', 'a''b;c', "say \"hi;\"");SELECT 1`,
+			want:   []string{`INSERT INTO a VALUES ('it\'s;', 'a''b;c', "say \"hi;\"")`, "SELECT 1"},
+		},
+		{
+			name:   "backslash in identifier",
+			script: "SELECT `a\\`;SELECT 2",
+			want:   []string{"SELECT `a\\`", "SELECT 2"},
+		},
+		{
+			name:   "comment quotes",
+			script: "SELECT '-- not a comment', '/* nor this */', '# nor this';",
+			want:   []string{"SELECT '-- not a comment', '/* nor this */', '# nor this'"},
+		},
+		{
+			name:   "line comments",
+			script: "-- creates a; really\nCREATE TABLE a (id INT); # trailing; comment\nSELECT 1",
+			want:   []string{"CREATE TABLE a (id INT)", "SELECT 1"},
+		},
+		{
+			name:   "double dash without whitespace",
+			script: "SELECT 1--1;SELECT 2",
+			want:   []string{"SELECT 1--1", "SELECT 2"},
+		},
+		{
+			name:   "line comment at the end",
+			script: "SELECT 1; -- done",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "block comments",
+			script: "CREATE /* the; table */ TABLE a (id INT);/* multi\nline; */SELECT 1",
+			want:   []string{"CREATE   TABLE a (id INT)", "SELECT 1"},
+		},
+		{
+			name:   "unterminated block comment",
+			script: "SELECT 1; /* never closed; SELECT 2",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "executable comments",
+			script: "/*!40101 SET NAMES utf8mb4 */;CREATE TABLE a (id INT) /*M!100100 ENGINE=InnoDB */;",
+			want:   []string{"/*!40101 SET NAMES utf8mb4 */", "CREATE TABLE a (id INT) /*M!100100 ENGINE=InnoDB */"},
+		},
+		{
+			name:   "executable comment holding a semicolon",
+			script: "/*!50003 SET @a = 1; */;SELECT 1",
+			want:   []string{"/*!50003 SET @a = 1; */", "SELECT 1"},
+		},
+		{
+			name:   "unterminated executable comment",
+			script: "SELECT 1;/*! SET @a = 1",
+			want:   []string{"SELECT 1", "/*! SET @a = 1"},
+		},
+		{
+			name: "delimiter",
+			script: "DELIMITER $$\n" +
+				"CREATE TRIGGER t BEFORE INSERT ON a FOR EACH ROW BEGIN SET NEW.id = 1; SET NEW.b = ';'; END$$\n" +
+				"DELIMITER ;\n" +
+				"SELECT 1;",
+			want: []string{
+				"CREATE TRIGGER t BEFORE INSERT ON a FOR EACH ROW BEGIN SET NEW.id = 1; SET NEW.b = ';'; END",
+				"SELECT 1",
+			},
+		},
+		{
+			name:   "lower case delimiter after a comment",
+			script: "-- routines\ndelimiter //\nCREATE PROCEDURE p() BEGIN SELECT 1; END //\ndelimiter ;\nCALL p();",
+			want:   []string{"CREATE PROCEDURE p() BEGIN SELECT 1; END", "CALL p()"},
+		},
+		{
+			name:   "delimiter inside a statement",
+			script: "SELECT 'DELIMITER $$' AS a, 1 AS delimiter;",
+			want:   []string{"SELECT 'DELIMITER $$' AS a, 1 AS delimiter"},
+		},
+		{
+			name:   "empty",
+			script: " \n-- nothing\n/* here */",
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitSQLStatements(test.script); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("splitSQLStatements(%q)\n got %q\nwant %q", test.script, got, test.want)
+			}
+		})
+	}
+}
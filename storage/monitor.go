@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the last known state of a connection checked by the monitor
+type ConnectionState string
+
+const (
+	ConnectionStateUnknown ConnectionState = "unknown"
+	ConnectionStateUp      ConnectionState = "up"
+	ConnectionStateDown    ConnectionState = "down"
+)
+
+// ConnectionEvent reports a connection going down or recovering
+type ConnectionEvent struct {
+	Name  string          `json:"name"`
+	Addr  string          `json:"addr"`
+	State ConnectionState `json:"state"`
+
+	// Err is why the connection is down, nil when it recovered
+	Err error `json:"-"`
+
+	// Duration is how long the connection stayed in its previous state
+	Duration time.Duration `json:"duration"`
+	At       time.Time     `json:"at"`
+}
+
+var (
+	connectionListeners      []func(ConnectionEvent)
+	connectionListenersMutex sync.RWMutex
+)
+
+// OnConnectionStateChange registers a function called every time a monitored connection goes down or recovers.
+// The clients reconnect on their own, the monitor only observes them
+func OnConnectionStateChange(listener func(ConnectionEvent)) {
+	connectionListenersMutex.Lock()
+	defer connectionListenersMutex.Unlock()
+	connectionListeners = append(connectionListeners, listener)
+}
+
+// connectionMonitor checks a connection periodically and reports its state transitions
+type connectionMonitor struct {
+	name     string
+	addr     string
+	interval time.Duration
+	check    func(ctx context.Context) error
+
+	mutex sync.RWMutex
+	state ConnectionState
+	since time.Time
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// startConnectionMonitor checks the connection every interval, nil is returned when interval is 0.
+// The connection is assumed up since it has just been verified
+func startConnectionMonitor(name, addr string, interval time.Duration, check func(ctx context.Context) error) *connectionMonitor {
+	if interval <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &connectionMonitor{
+		name:     name,
+		addr:     addr,
+		interval: interval,
+		check:    check,
+		state:    ConnectionStateUp,
+		since:    time.Now(),
+		stop:     cancel,
+		done:     make(chan struct{}),
+	}
+	go m.run(ctx)
+
+	return m
+}
+
+// State returns the last known state of the connection, unknown when it isn't monitored
+func (m *connectionMonitor) State() ConnectionState {
+	if m == nil {
+		return ConnectionStateUnknown
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.state
+}
+
+// Close stops the monitor and waits for the running check to return
+func (m *connectionMonitor) Close() {
+	if m == nil {
+		return
+	}
+
+	m.stop()
+	<-m.done
+}
+
+func (m *connectionMonitor) run(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, m.interval)
+			err := m.check(checkCtx)
+			cancel()
+
+			// A check interrupted by Close says nothing about the connection
+			if ctx.Err() != nil {
+				return
+			}
+			m.update(err)
+		}
+	}
+}
+
+func (m *connectionMonitor) update(err error) {
+	state := ConnectionStateUp
+	if err != nil {
+		state = ConnectionStateDown
+	}
+
+	m.mutex.Lock()
+	if state == m.state {
+		m.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	event := ConnectionEvent{Name: m.name, Addr: m.addr, State: state, Err: err, Duration: now.Sub(m.since), At: now}
+	m.state = state
+	m.since = now
+	m.mutex.Unlock()
+
+	if state == ConnectionStateDown {
+		slog.Error("connection lost", "name", m.name, "addr", m.addr, "uptime", event.Duration, "reason", err)
+	} else {
+		slog.Info("connection recovered", "name", m.name, "addr", m.addr, "downtime", event.Duration)
+	}
+
+	connectionListenersMutex.RLock()
+	listeners := connectionListeners
+	connectionListenersMutex.RUnlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
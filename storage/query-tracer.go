@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxQueryFingerprints bounds the memory of the statistics, statements beyond it are counted under otherQueryFingerprint
+const (
+	maxQueryFingerprints  = 1000
+	otherQueryFingerprint = "other"
+)
+
+// Frames skipped when looking for the caller of a statement
+var queryCallerSkippedPrefixes = []string{
+	"runtime.",
+	"database/sql.",
+	"github.com/go-sql-driver/",
+	"gorm.io/",
+	"github.com/voxtmault/panacea-shared-lib/storage.(*traced",
+	"github.com/voxtmault/panacea-shared-lib/storage.(*QueryTracer)",
+}
+
+var (
+	fingerprintLiteralPattern = regexp.MustCompile(`(?s)'(?:[^'\\]|\\.|'')*(?:'|$)|"(?:[^"\\]|\\.|"")*(?:"|$)|/\*.*?(?:\*/|$)|(?:--(?:\s|$)|#)[^\n]*`)
+	fingerprintNumberPattern  = regexp.MustCompile(`\b(?:0x[0-9a-fA-F]+|\d+(?:\.\d+)?(?:[eE][-+]?\d+)?)\b`)
+	fingerprintListPattern    = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintTuplesPattern  = regexp.MustCompile(`\(\?\+\)(?:\s*,\s*\(\?\+\))+`)
+	fingerprintSpacePattern   = regexp.MustCompile(`\s+`)
+)
+
+// QueryEvent describes a single statement sent to the server
+type QueryEvent struct {
+	// Query is the statement as sent by the caller, it may hold literal values and shouldn't be logged as is
+	Query       string        `json:"query"`
+	Fingerprint string        `json:"fingerprint"`
+	Duration    time.Duration `json:"duration"`
+
+	// Rows is the number of rows affected by a statement or returned by a query
+	Rows int64 `json:"rows"`
+
+	// Caller is the file:line that issued the statement, only resolved for slow statements and for the observer
+	Caller string `json:"caller,omitempty"`
+	Err    error  `json:"-"`
+}
+
+// QueryStats aggregates the statements sharing a fingerprint
+type QueryStats struct {
+	Fingerprint   string        `json:"fingerprint"`
+	Count         int64         `json:"count"`
+	Errors        int64         `json:"errors"`
+	Slow          int64         `json:"slow"`
+	Rows          int64         `json:"rows"`
+	TotalDuration time.Duration `json:"total_duration"`
+	MaxDuration   time.Duration `json:"max_duration"`
+	MeanDuration  time.Duration `json:"mean_duration"`
+
+	// LastSlowCaller is where the last slow statement of the fingerprint came from
+	LastSlowCaller string `json:"last_slow_caller,omitempty"`
+}
+
+// QueryTracer records the statements going through the traced driver, logging the slow ones and aggregating
+// statistics per query fingerprint, where literals are replaced by placeholders
+type QueryTracer struct {
+	slowThreshold atomic.Int64
+	observer      atomic.Pointer[func(QueryEvent)]
+
+	mutex sync.Mutex
+	stats map[string]*QueryStats
+}
+
+// NewQueryTracer returns a tracer logging the fingerprint of statements slower than slowThreshold,
+// 0 disables slow statement logging
+func NewQueryTracer(slowThreshold time.Duration) *QueryTracer {
+	t := &QueryTracer{stats: make(map[string]*QueryStats)}
+	t.SetSlowThreshold(slowThreshold)
+	return t
+}
+
+// SetSlowThreshold changes the duration above which statements are logged, 0 disables slow statement logging
+func (t *QueryTracer) SetSlowThreshold(threshold time.Duration) {
+	t.slowThreshold.Store(int64(threshold))
+}
+
+// SetObserver registers a function called after every statement, nil removes it.
+// It runs on the goroutine of the statement and must be fast
+func (t *QueryTracer) SetObserver(observer func(QueryEvent)) {
+	if observer == nil {
+		t.observer.Store(nil)
+		return
+	}
+	t.observer.Store(&observer)
+}
+
+// Stats returns the statistics of every fingerprint, the most time consuming first
+func (t *QueryTracer) Stats() []QueryStats {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	stats := make([]QueryStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		copied := *s
+		if copied.Count > 0 {
+			copied.MeanDuration = copied.TotalDuration / time.Duration(copied.Count)
+		}
+		stats = append(stats, copied)
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalDuration > stats[j].TotalDuration
+	})
+
+	return stats
+}
+
+// Reset clears the statistics
+func (t *QueryTracer) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stats = make(map[string]*QueryStats)
+}
+
+// record is called by the traced driver once a statement is done
+func (t *QueryTracer) record(ctx context.Context, query string, duration time.Duration, rows int64, err error) {
+	event := QueryEvent{
+		Query:       query,
+		Fingerprint: fingerprintQuery(query),
+		Duration:    duration,
+		Rows:        rows,
+		Err:         err,
+	}
+
+	threshold := time.Duration(t.slowThreshold.Load())
+	slow := threshold > 0 && duration > threshold
+	observer := t.observer.Load()
+	if slow || observer != nil {
+		event.Caller = queryCaller()
+	}
+
+	t.mutex.Lock()
+	stats, found := t.stats[event.Fingerprint]
+	if !found {
+		key := event.Fingerprint
+		if len(t.stats) >= maxQueryFingerprints {
+			key = otherQueryFingerprint
+		}
+		if stats, found = t.stats[key]; !found {
+			stats = &QueryStats{Fingerprint: key}
+			t.stats[key] = stats
+		}
+	}
+	stats.Count++
+	stats.Rows += rows
+	stats.TotalDuration += duration
+	stats.MaxDuration = max(stats.MaxDuration, duration)
+	if err != nil {
+		stats.Errors++
+	}
+	if slow {
+		stats.Slow++
+		stats.LastSlowCaller = event.Caller
+	}
+	t.mutex.Unlock()
+
+	if slow {
+		slog.WarnContext(ctx, "slow query",
+			"fingerprint", event.Fingerprint, "duration", duration, "threshold", threshold, "rows", rows, "caller", event.Caller)
+	}
+	if observer != nil {
+		(*observer)(event)
+	}
+}
+
+// fingerprintQuery replaces the literals of a statement with placeholders, drops its comments and collapses lists and
+// tuples of placeholders, so the executions of a statement with different values share a fingerprint and no value
+// reaches the logs
+func fingerprintQuery(query string) string {
+	fingerprint := fingerprintLiteralPattern.ReplaceAllStringFunc(query, func(literal string) string {
+		if literal[0] == '\'' || literal[0] == '"' {
+			return "?"
+		}
+		return " "
+	})
+	fingerprint = fingerprintNumberPattern.ReplaceAllString(fingerprint, "?")
+	fingerprint = fingerprintListPattern.ReplaceAllString(fingerprint, "(?+)")
+	fingerprint = fingerprintTuplesPattern.ReplaceAllString(fingerprint, "(?+)+")
+	fingerprint = fingerprintSpacePattern.ReplaceAllString(fingerprint, " ")
+
+	return strings.TrimSpace(fingerprint)
+}
+
+// queryCaller returns the file:line of the first frame outside of database/sql, the drivers and GORM
+func queryCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	for {
+		frame, more := frames.Next()
+		if !isSkippedQueryFrame(frame.Function) {
+			return frame.File + ":" + strconv.Itoa(frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+func isSkippedQueryFrame(function string) bool {
+	for _, prefix := range queryCallerSkippedPrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
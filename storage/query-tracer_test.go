@@ -0,0 +1,57 @@
+package storage
+
+import "testing"
+
+func TestFingerprintQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "placeholders", query: "SELECT * FROM media WHERE id = ?", want: "SELECT * FROM media WHERE id = ?"},
+
+		// Strings
+		{name: "single quoted", query: "SELECT * FROM users WHERE email = 'john@example.com'", want: "SELECT * FROM users WHERE email = ?"},
+		{name: "double quoted", query: `SELECT * FROM users WHERE name = "John"`, want: "SELECT * FROM users WHERE name = ?"},
+		{name: "escaped quotes", query: `SELECT 'it\'s', 'it''s', "say \"hi\""`, want: "SELECT ?, ?, ?"},
+		{name: "multiline string", query: "INSERT INTO notes (body) VALUES ('line 1\nline 2')", want: "INSERT INTO notes (body) VALUES (?+)"},
+		{name: "string holding a comment", query: "SELECT '-- not a comment', '/* nor */'", want: "SELECT ?, ?"},
+		{name: "unterminated string", query: "SELECT * FROM users WHERE email = 'john@exa", want: "SELECT * FROM users WHERE email = ?"},
+		{name: "identifiers", query: "SELECT `email`, t1.id FROM `users_2024` t1", want: "SELECT `email`, t1.id FROM `users_2024` t1"},
+
+		// Numbers
+		{name: "integer", query: "SELECT * FROM media WHERE id = 42", want: "SELECT * FROM media WHERE id = ?"},
+		{name: "decimal and exponent", query: "SELECT 3.14, 1e10, 2.5E-3", want: "SELECT ?, ?, ?"},
+		{name: "negative", query: "UPDATE accounts SET balance = -100", want: "UPDATE accounts SET balance = -?"},
+		{name: "hexadecimal", query: "SELECT 0x1F, X'ABCD'", want: "SELECT ?, X?"},
+		{name: "limit", query: "SELECT * FROM media LIMIT 10 OFFSET 20", want: "SELECT * FROM media LIMIT ? OFFSET ?"},
+
+		// Lists and tuples
+		{name: "in list", query: "SELECT * FROM media WHERE id IN (1, 2, 3)", want: "SELECT * FROM media WHERE id IN (?+)"},
+		{name: "in placeholders", query: "SELECT * FROM media WHERE id IN (?,?,?,?)", want: "SELECT * FROM media WHERE id IN (?+)"},
+		{name: "mixed in list", query: "SELECT * FROM users WHERE name IN ('a', ?, 'c')", want: "SELECT * FROM users WHERE name IN (?+)"},
+		{name: "single value", query: "SELECT * FROM media WHERE id IN (7)", want: "SELECT * FROM media WHERE id IN (?+)"},
+		{name: "tuples", query: "INSERT INTO media (id, name) VALUES (1, 'a'), (2, 'b'), (3, 'c')", want: "INSERT INTO media (id, name) VALUES (?+)+"},
+		{name: "same fingerprint", query: "INSERT INTO media (id, name) VALUES (?, ?)", want: "INSERT INTO media (id, name) VALUES (?+)"},
+		{name: "function call", query: "SELECT COUNT(*) FROM media WHERE created_at > NOW()", want: "SELECT COUNT(*) FROM media WHERE created_at > NOW()"},
+
+		// Comments
+		{name: "block comment", query: "SELECT /* user john@example.com */ * FROM media", want: "SELECT * FROM media"},
+		{name: "multiline block comment", query: "/* request\nid 1234 */ SELECT 1", want: "SELECT ?"},
+		{name: "executable comment", query: "SELECT /*+ MAX_EXECUTION_TIME(1000) */ * FROM media", want: "SELECT * FROM media"},
+		{name: "unterminated block comment", query: "SELECT * FROM media /* secret", want: "SELECT * FROM media"},
+		{name: "dash comment", query: "SELECT * FROM media -- for john@example.com\nWHERE id = 1", want: "SELECT * FROM media WHERE id = ?"},
+		{name: "dash comment at the end", query: "SELECT 1 --", want: "SELECT ?"},
+		{name: "double minus", query: "SELECT 5--1", want: "SELECT ?--?"},
+		{name: "hash comment", query: "SELECT 1 # secret", want: "SELECT ?"},
+
+		// Whitespace
+		{name: "whitespace", query: "  SELECT\n\t*\n  FROM   media  ", want: "SELECT * FROM media"},
+	}
+
+	for _, test := range tests {
+		if got := fingerprintQuery(test.query); got != test.want {
+			t.Errorf("%s: fingerprintQuery(%q) = %q, want %q", test.name, test.query, got, test.want)
+		}
+	}
+}
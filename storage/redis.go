@@ -4,14 +4,44 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/rotisserie/eris"
 	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/voxtmault/panacea-shared-lib/health"
 )
 
-var redisClient *redis.Client
+var (
+	ErrRedisNotInitialized     = eris.New("redis connection has not been initialized")
+	ErrRedisAlreadyInitialized = eris.New("redis connection is already initialized, call CloseRedis first")
+)
+
+// defaultRedis is the client behind the package level functions, set by InitRedis
+var defaultRedis atomic.Pointer[Redis]
+
+// RedisStats is a snapshot of the connection pool statistics, Hits, Misses, Timeouts and StaleConnections are totals
+// since the pool was opened
+type RedisStats struct {
+	// Hits and Misses count the times a free connection was or wasn't found in the pool
+	Hits     uint32 `json:"hits"`
+	Misses   uint32 `json:"misses"`
+	Timeouts uint32 `json:"timeouts"`
+
+	TotalConnections int `json:"total_connections"`
+	IdleConnections  int `json:"idle_connections"`
+
+	// StaleConnections counts the connections removed from the pool for being stale
+	StaleConnections uint32 `json:"stale_connections"`
+}
+
+// Redis is a client of a redis server holding its own connection pool and config
+type Redis struct {
+	config  config.RedisConfig
+	client  *redis.Client
+	monitor *connectionMonitor
+}
 
 func validateRedisConfig(cfg *config.RedisConfig) error {
 	if cfg.RedisHost == "" {
@@ -27,45 +57,174 @@ func validateRedisConfig(cfg *config.RedisConfig) error {
 	return nil
 }
 
-func InitRedis(config *config.RedisConfig) error {
-
+// NewRedis opens and verifies a connection to the redis server of the config, it waits for up to RedisStartupTimeout
+// for the server to become reachable
+func NewRedis(config *config.RedisConfig) (*Redis, error) {
 	if err := validateRedisConfig(config); err != nil {
-		return eris.Wrap(err, "invalid redis configuration")
+		return nil, eris.Wrap(err, "invalid redis configuration")
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort),
+	addr := fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort)
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
 		Password: config.RedisPassword,
 		DB:       int(config.RedisDBNum),
 	})
 
-	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
-		return eris.Wrap(err, "Init Redis")
+	err := retryStartup(HealthCheckRedis,
+		time.Second*time.Duration(config.RedisStartupTimeout),
+		time.Millisecond*time.Duration(config.RedisStartupRetryInterval),
+		func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		},
+	)
+	if err != nil {
+		client.Close()
+		return nil, eris.Wrap(err, "Init Redis")
+	}
+
+	r := &Redis{config: *config, client: client}
+	r.monitor = startConnectionMonitor(HealthCheckRedis, addr, time.Second*time.Duration(config.RedisMonitorInterval), r.Ping)
+
+	return r, nil
+}
+
+// InitRedis connects the default client used by the package level functions. It fails while a default client is
+// set, CloseRedis it first to reconnect
+func InitRedis(config *config.RedisConfig) error {
+	if defaultRedis.Load() != nil {
+		return ErrRedisAlreadyInitialized
 	}
 
+	r, err := NewRedis(config)
+	if err != nil {
+		return err
+	}
+	if !defaultRedis.CompareAndSwap(nil, r) {
+		r.Close()
+		return ErrRedisAlreadyInitialized
+	}
+
+	health.Register(HealthCheckRedis, health.Readiness, pingRedis)
+
 	slog.Info("Successfully opened redis connection")
 	return nil
 }
 
-func CloseRedis() error {
-	if err := redisClient.Close(); err != nil {
-		return eris.Wrap(err, "Closing redis connection")
+// SetDefaultRedis replaces the client used by the package level functions, the caller stays in charge of closing
+// the previous one
+func SetDefaultRedis(r *Redis) {
+	defaultRedis.Store(r)
+}
+
+// GetDefaultRedis returns the client used by the package level functions, nil until InitRedis succeeds and
+// after CloseRedis
+func GetDefaultRedis() *Redis {
+	return defaultRedis.Load()
+}
+
+// pingRedis is the health check of the default redis client
+func pingRedis(ctx context.Context) error {
+	return defaultRedis.Load().Ping(ctx)
+}
+
+// Client returns the underlying redis client, nil when r is nil
+func (r *Redis) Client() *redis.Client {
+	if r == nil {
+		return nil
+	}
+	return r.client
+}
+
+// Config returns a copy of the config the client was created with
+func (r *Redis) Config() config.RedisConfig {
+	if r == nil {
+		return config.RedisConfig{}
+	}
+	return r.config
+}
+
+// Ping verifies the connection to the redis server
+func (r *Redis) Ping(ctx context.Context) error {
+	if r == nil || r.client == nil {
+		return ErrRedisNotInitialized
+	}
+
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return eris.Wrap(err, "pinging redis")
 	}
 
 	return nil
 }
 
-func GetRedisCon() *redis.Client {
-	return redisClient
+// State returns the state of the connection last seen by the connection monitor, unknown when it is disabled
+func (r *Redis) State() ConnectionState {
+	if r == nil {
+		return ConnectionStateUnknown
+	}
+	return r.monitor.State()
 }
 
-func SaveToRedis(ctx context.Context, key string, value interface{}) error {
-	cfg := config.GetConfig()
-	con := GetRedisCon()
+// Stats returns the statistics of the connection pool, zero when r is nil
+func (r *Redis) Stats() RedisStats {
+	if r == nil || r.client == nil {
+		return RedisStats{}
+	}
 
-	if err := con.Set(ctx, key, value, time.Minute*time.Duration(cfg.RedisConfig.RedisExpiration)).Err(); err != nil {
+	stats := r.client.PoolStats()
+	return RedisStats{
+		Hits:             stats.Hits,
+		Misses:           stats.Misses,
+		Timeouts:         stats.Timeouts,
+		TotalConnections: int(stats.TotalConns),
+		IdleConnections:  int(stats.IdleConns),
+		StaleConnections: stats.StaleConns,
+	}
+}
+
+// Save stores value under key, expiring after the RedisExpiration minutes of the client config
+func (r *Redis) Save(ctx context.Context, key string, value interface{}) error {
+	if r == nil || r.client == nil {
+		return ErrRedisNotInitialized
+	}
+
+	if err := r.client.Set(ctx, key, value, time.Minute*time.Duration(r.config.RedisExpiration)).Err(); err != nil {
 		return eris.Wrap(err, "saving data to redis cache")
 	}
 
 	return nil
 }
+
+// Close stops the connection monitor and closes the connection pool of the client, calling it again is a no-op
+func (r *Redis) Close() error {
+	if r == nil || r.client == nil {
+		return nil
+	}
+
+	r.monitor.Close()
+
+	if err := r.client.Close(); err != nil {
+		return eris.Wrap(err, "Closing redis connection")
+	}
+
+	return nil
+}
+
+func CloseRedis() error {
+	health.Unregister(HealthCheckRedis)
+
+	return defaultRedis.Swap(nil).Close()
+}
+
+// GetRedisStats returns the statistics of the default connection pool, zero when InitRedis hasn't run
+func GetRedisStats() RedisStats {
+	return defaultRedis.Load().Stats()
+}
+
+func GetRedisCon() *redis.Client {
+	return defaultRedis.Load().Client()
+}
+
+func SaveToRedis(ctx context.Context, key string, value interface{}) error {
+	return defaultRedis.Load().Save(ctx, key, value)
+}
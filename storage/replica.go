@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/panacea-shared-lib/config"
+	"gorm.io/gorm"
+)
+
+var (
+	_ gorm.ConnPool       = (*DBRouter)(nil)
+	_ gorm.TxBeginner     = (*DBRouter)(nil)
+	_ gorm.GetDBConnector = (*DBRouter)(nil)
+)
+
+// lockingReadPattern matches reads that take locks, they must run on the primary
+var lockingReadPattern = regexp.MustCompile(`(?i)\b(FOR\s+UPDATE|LOCK\s+IN\s+SHARE\s+MODE|FOR\s+SHARE)\b`)
+
+// sideEffectPattern matches reads with side effects or depending on the session of the primary,
+// such as SELECT ... INTO, advisory locks, sequences and the results of the last write
+var sideEffectPattern = regexp.MustCompile(
+	`(?i)\bINTO\b|\b(GET_LOCK|RELEASE_LOCK|RELEASE_ALL_LOCKS|IS_USED_LOCK|IS_FREE_LOCK|NEXTVAL|SETVAL|LASTVAL|` +
+		`LAST_INSERT_ID|FOUND_ROWS|ROW_COUNT)\s*\(|\bNEXT\s+VALUE\s+FOR\b`,
+)
+
+// readStatementPattern matches the statements that may run on a replica, once leading comments are stripped
+var readStatementPattern = regexp.MustCompile(`(?i)^\(*\s*(SELECT|SHOW|WITH)\b`)
+
+// leadingCommentPattern matches the whitespace and comments before the first keyword of a statement
+var leadingCommentPattern = regexp.MustCompile(`^(\s+|/\*[^!M][\s\S]*?\*/|/\*\*/|(--\s|#)[^\n]*(\n|$))+`)
+
+type primaryContextKey struct{}
+
+// WithPrimary returns a context whose queries go to the primary even through the router, used by reads that must
+// see the writes made just before them
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// ReplicaStatus is the last known state of a read replica
+type ReplicaStatus struct {
+	Addr      string        `json:"addr"`
+	Healthy   bool          `json:"healthy"`
+	Lag       time.Duration `json:"lag"`
+	LastError string        `json:"last_error,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+type replica struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+
+	mutex  sync.RWMutex
+	status ReplicaStatus
+}
+
+// DBRouter sends reads to healthy read replicas in a round-robin fashion and everything else to the primary.
+// It implements the connection pool interfaces of GORM, see GetGORMReadDB
+type DBRouter struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     atomic.Uint64
+
+	maxLag        time.Duration
+	checkInterval time.Duration
+	stop          context.CancelFunc
+	done          chan struct{}
+}
+
+// newDBRouter opens the replicas of the config and checks them in the background, they receive no read until their
+// first check succeeds. Their statements are recorded to the tracer of the primary, nil disables tracing
+func newDBRouter(config *config.DBConfig, primary *sql.DB, tracer *QueryTracer) (*DBRouter, error) {
+	router := &DBRouter{
+		primary:       primary,
+		maxLag:        time.Second * time.Duration(config.ReplicaMaxLag),
+		checkInterval: time.Second * time.Duration(config.ReplicaCheckInterval),
+		done:          make(chan struct{}),
+	}
+	if router.maxLag <= 0 {
+		router.maxLag = time.Second * 10
+	}
+	if router.checkInterval <= 0 {
+		router.checkInterval = time.Second * 5
+	}
+
+	for _, host := range config.ReplicaHosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		addr := host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			addr = net.JoinHostPort(host, config.DBPort)
+		}
+
+		db, err := openMariaDB(config, addr, tracer)
+		if err != nil {
+			router.closeReplicas()
+			return nil, eris.Wrapf(err, "opening replica %s", addr)
+		}
+		router.replicas = append(router.replicas, &replica{addr: addr, db: db, status: ReplicaStatus{Addr: addr}})
+	}
+
+	// Checking the replicas doesn't hold the startup, the primary takes the reads until they are found healthy
+	ctx, cancel := context.WithCancel(context.Background())
+	router.stop = cancel
+	go router.monitor(ctx)
+
+	return router, nil
+}
+
+// GetDBRouter returns the router of the MariaDB connection, nil when no replica is configured
+func GetDBRouter() *DBRouter {
+	return defaultMariaDB.Load().Router()
+}
+
+// GetReadDBConnection returns a healthy read replica, falling back to the primary when none is available or
+// no replica is configured. Only use it for reads that can tolerate the replication lag
+func GetReadDBConnection() *sql.DB {
+	return defaultMariaDB.Load().ReadDB()
+}
+
+// Primary returns the primary connection, used for writes and transactions
+func (r *DBRouter) Primary() *sql.DB {
+	return r.primary
+}
+
+// Reader returns the next healthy replica, or the primary when every replica is unhealthy
+func (r *DBRouter) Reader() *sql.DB {
+	count := uint64(len(r.replicas))
+	if count == 0 {
+		return r.primary
+	}
+
+	start := r.next.Add(1)
+	for i := uint64(0); i < count; i++ {
+		if candidate := r.replicas[(start+i)%count]; candidate.healthy.Load() {
+			return candidate.db
+		}
+	}
+
+	return r.primary
+}
+
+// Status returns the last known state of every replica
+func (r *DBRouter) Status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(r.replicas))
+	for _, replica := range r.replicas {
+		replica.mutex.RLock()
+		statuses = append(statuses, replica.status)
+		replica.mutex.RUnlock()
+	}
+
+	return statuses
+}
+
+// QueryContext runs SELECT, SHOW and WITH statements on a replica, see route
+func (r *DBRouter) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return r.route(ctx, query).QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs SELECT, SHOW and WITH statements on a replica, see route
+func (r *DBRouter) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return r.route(ctx, query).QueryRowContext(ctx, query, args...)
+}
+
+// ExecContext runs the statement on the primary
+func (r *DBRouter) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return r.primary.ExecContext(ctx, query, args...)
+}
+
+// PrepareContext prepares the statement on the primary, the statement may be used for writes.
+// GORM prepares every statement with GORMPrepareStmt, so all its reads go to the primary then
+func (r *DBRouter) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return r.primary.PrepareContext(ctx, query)
+}
+
+// BeginTx starts a transaction on the primary
+func (r *DBRouter) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return r.primary.BeginTx(ctx, opts)
+}
+
+// GetDBConn returns the primary, it is what GORM returns from DB()
+func (r *DBRouter) GetDBConn() (*sql.DB, error) {
+	return r.primary, nil
+}
+
+// Close stops the health checks and closes the replicas, the primary is left open
+func (r *DBRouter) Close() error {
+	r.stop()
+	<-r.done
+
+	return r.closeReplicas()
+}
+
+// route sends plain reads to a replica. Everything else goes to the primary: writes, INSERT ... RETURNING, CALL,
+// locking reads, reads with side effects, multiple statements and the queries of a context made by WithPrimary.
+// The checks are textual, a read mentioning one of these keywords in a literal goes to the primary as well
+func (r *DBRouter) route(ctx context.Context, query string) *sql.DB {
+	if primary, _ := ctx.Value(primaryContextKey{}).(bool); primary {
+		return r.primary
+	}
+
+	statement := leadingCommentPattern.ReplaceAllString(query, "")
+	if !readStatementPattern.MatchString(statement) ||
+		strings.Contains(strings.TrimRight(statement, "; \t\r\n"), ";") ||
+		lockingReadPattern.MatchString(statement) ||
+		sideEffectPattern.MatchString(statement) {
+		return r.primary
+	}
+
+	return r.Reader()
+}
+
+func (r *DBRouter) closeReplicas() error {
+	var closeErr error
+	for _, replica := range r.replicas {
+		if err := replica.db.Close(); err != nil {
+			closeErr = eris.Wrapf(err, "closing replica %s", replica.addr)
+		}
+	}
+
+	return closeErr
+}
+
+// monitor checks the replicas right away then every checkInterval until the context is cancelled
+func (r *DBRouter) monitor(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		r.checkReplicas(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkReplicas checks every replica in parallel, so an unreachable one doesn't delay the others
+func (r *DBRouter) checkReplicas(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, replica := range r.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.checkReplica(ctx, replica)
+		}()
+	}
+	wg.Wait()
+}
+
+func (r *DBRouter) checkReplica(ctx context.Context, replica *replica) {
+	checkCtx, cancel := context.WithTimeout(ctx, r.checkInterval)
+	lag, err := replicationLag(checkCtx, replica.db)
+	cancel()
+
+	// The router is closing, the result says nothing about the replica
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err == nil && lag > r.maxLag {
+		err = eris.Errorf("replication lag of %s exceeds %s", lag, r.maxLag)
+	}
+	healthy := err == nil
+
+	replica.mutex.RLock()
+	checked := !replica.status.CheckedAt.IsZero()
+	replica.mutex.RUnlock()
+
+	// Replicas start unhealthy, one that is down from the start is still reported
+	if healthy != replica.healthy.Load() || !checked && !healthy {
+		if healthy {
+			slog.Info("read replica is healthy", "addr", replica.addr, "lag", lag)
+		} else {
+			slog.Warn("read replica is unhealthy, reads go elsewhere", "addr", replica.addr, "reason", err)
+		}
+	}
+
+	status := ReplicaStatus{Addr: replica.addr, Healthy: healthy, Lag: lag, CheckedAt: time.Now()}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+
+	replica.mutex.Lock()
+	replica.status = status
+	replica.mutex.Unlock()
+	replica.healthy.Store(healthy)
+}
+
+// replicationLag returns how far the replica is behind its primary, based on Seconds_Behind_Master.
+// Requires the REPLICATION CLIENT (or SLAVE MONITOR) privilege
+func replicationLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, WrapMariaDBError(MariaDBErrorsQuery, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, WrapMariaDBError(MariaDBErrorsQuery, err)
+	}
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, WrapMariaDBError(MariaDBErrorsQuery, err)
+		}
+		return 0, eris.New("server is not a replica")
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	targets := make([]any, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	if err = rows.Scan(targets...); err != nil {
+		return 0, WrapMariaDBError(MariaDBErrorsScanResult, err)
+	}
+
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+
+		// NULL means the replication threads are stopped
+		if values[i] == nil {
+			return 0, eris.New("replication is not running")
+		}
+
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, eris.Wrap(err, "parsing replication lag")
+		}
+		return time.Second * time.Duration(seconds), nil
+	}
+
+	return 0, eris.New("replication lag is not reported")
+}
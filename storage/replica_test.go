@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/voxtmault/panacea-shared-lib/config"
+)
+
+// newTestDB returns a connection pool that never connects, only its identity matters to the router
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(mariaDriver, "user:password@tcp(127.0.0.1:1)/test")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newTestRouter returns a router over a primary and healthy replicas, without health checks
+func newTestRouter(t *testing.T, replicas int) *DBRouter {
+	t.Helper()
+
+	router := &DBRouter{primary: newTestDB(t)}
+	for range replicas {
+		r := &replica{addr: "replica", db: newTestDB(t)}
+		r.healthy.Store(true)
+		router.replicas = append(router.replicas, r)
+	}
+
+	return router
+}
+
+func TestDBRouterRoute(t *testing.T) {
+	router := newTestRouter(t, 1)
+	replicaDB := router.replicas[0].db
+
+	tests := []struct {
+		query       string
+		wantReplica bool
+	}{
+		// Plain reads
+		{query: "SELECT * FROM media", wantReplica: true},
+		{query: "  select id from media where ref_id = ?", wantReplica: true},
+		{query: "SELECT 1;", wantReplica: true},
+		{query: "(SELECT 1) UNION (SELECT 2)", wantReplica: true},
+		{query: "WITH recent AS (SELECT * FROM media) SELECT * FROM recent", wantReplica: true},
+		{query: "SHOW TABLES", wantReplica: true},
+		{query: "SELECT intotal, `into_count`, point_into FROM stats", wantReplica: true},
+		{query: "SELECT last_insert_id_column FROM media", wantReplica: true},
+
+		// Leading comments
+		{query: "/* list media */ SELECT * FROM media", wantReplica: true},
+		{query: "/**/SELECT 1", wantReplica: true},
+		{query: "-- list media\nSELECT * FROM media", wantReplica: true},
+		{query: "# list media\n  /* twice */ SELECT * FROM media", wantReplica: true},
+		{query: "/* SELECT */ DELETE FROM media", wantReplica: false},
+		{query: "-- SELECT\nUPDATE media SET size = 0", wantReplica: false},
+		{query: "--SELECT 1", wantReplica: false},
+		{query: "/*!40001 SELECT 1 */", wantReplica: false},
+		{query: "/*M!100100 SELECT 1 */", wantReplica: false},
+
+		// Writes and calls
+		{query: "INSERT INTO media (id) VALUES (1)", wantReplica: false},
+		{query: "INSERT INTO media (id) VALUES (1) RETURNING id", wantReplica: false},
+		{query: "UPDATE media SET size = 1", wantReplica: false},
+		{query: "DELETE FROM media", wantReplica: false},
+		{query: "REPLACE INTO media (id) VALUES (1)", wantReplica: false},
+		{query: "CALL purge_media()", wantReplica: false},
+		{query: "SET @a = 1", wantReplica: false},
+		{query: "SELECT 1; DELETE FROM media", wantReplica: false},
+
+		// Locking reads
+		{query: "SELECT * FROM media WHERE id = 1 FOR UPDATE", wantReplica: false},
+		{query: "SELECT * FROM media WHERE id = 1 for\n update", wantReplica: false},
+		{query: "SELECT * FROM media LOCK IN SHARE MODE", wantReplica: false},
+		{query: "SELECT * FROM media FOR SHARE", wantReplica: false},
+
+		// Reads with side effects or depending on the session
+		{query: "SELECT id INTO @id FROM media LIMIT 1", wantReplica: false},
+		{query: "SELECT * FROM media INTO OUTFILE '/tmp/media'", wantReplica: false},
+		{query: "SELECT GET_LOCK('media', 10)", wantReplica: false},
+		{query: "SELECT release_lock ('media')", wantReplica: false},
+		{query: "SELECT LAST_INSERT_ID()", wantReplica: false},
+		{query: "SELECT FOUND_ROWS()", wantReplica: false},
+		{query: "SELECT ROW_COUNT()", wantReplica: false},
+		{query: "SELECT NEXTVAL(media_seq)", wantReplica: false},
+		{query: "SELECT NEXT VALUE FOR media_seq", wantReplica: false},
+
+		// The checks are textual, literals mentioning a keyword go to the primary
+		{query: "SELECT * FROM media WHERE name = 'into'", wantReplica: false},
+	}
+
+	for _, test := range tests {
+		got := router.route(context.Background(), test.query)
+		if (got == replicaDB) != test.wantReplica || (got != replicaDB && got != router.primary) {
+			t.Errorf("route(%q) sent the query to the replica: %t, want %t", test.query, got == replicaDB, test.wantReplica)
+		}
+	}
+}
+
+func TestDBRouterRouteWithPrimary(t *testing.T) {
+	router := newTestRouter(t, 1)
+
+	if got := router.route(WithPrimary(context.Background()), "SELECT * FROM media"); got != router.primary {
+		t.Fatal("a read of a WithPrimary context went to a replica")
+	}
+}
+
+func TestDBRouterReader(t *testing.T) {
+	router := newTestRouter(t, 3)
+
+	// Every healthy replica takes its turn
+	seen := make(map[*sql.DB]int)
+	for range 6 {
+		seen[router.Reader()]++
+	}
+	for _, replica := range router.replicas {
+		if seen[replica.db] != 2 {
+			t.Fatalf("replica picked %d times out of 6, want 2", seen[replica.db])
+		}
+	}
+
+	// Unhealthy replicas are skipped
+	router.replicas[0].healthy.Store(false)
+	router.replicas[2].healthy.Store(false)
+	for range 4 {
+		if got := router.Reader(); got != router.replicas[1].db {
+			t.Fatal("Reader returned an unhealthy replica")
+		}
+	}
+
+	// The primary takes over when none is healthy
+	router.replicas[1].healthy.Store(false)
+	if got := router.Reader(); got != router.primary {
+		t.Fatal("Reader didn't fall back to the primary")
+	}
+	if got := router.route(context.Background(), "SELECT 1"); got != router.primary {
+		t.Fatal("route didn't fall back to the primary")
+	}
+}
+
+func TestNewDBRouterDoesNotWaitForReplicas(t *testing.T) {
+	// The replicas accept connections but never answer, each check lasts until it times out
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().String()
+	start := time.Now()
+	router, err := newDBRouter(&config.DBConfig{
+		DBUser:               "user",
+		ReplicaHosts:         []string{addr, addr, addr},
+		ReplicaCheckInterval: 1,
+	}, newTestDB(t), nil)
+	if err != nil {
+		t.Fatalf("newDBRouter: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("newDBRouter took %s, it waited for the replica checks", elapsed)
+	}
+
+	if got := router.Reader(); got != router.primary {
+		t.Fatal("an unchecked replica received a read")
+	}
+	for _, status := range router.Status() {
+		if status.Addr != addr || status.Healthy {
+			t.Fatalf("unchecked replica reported as %+v", status)
+		}
+	}
+
+	// Close cancels the checks in flight instead of waiting for them
+	start = time.Now()
+	if err = router.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("Close took %s", elapsed)
+	}
+}
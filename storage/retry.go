@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	defaultStartupRetryInterval = time.Millisecond * 500
+	maxStartupRetryInterval     = time.Second * 10
+)
+
+// retryStartup calls connect until it succeeds or timeout elapses, waiting retryInterval before the first retry and
+// doubling the wait on every attempt. Only transient connection errors are retried, others such as wrong credentials
+// are returned at once. A timeout of 0 makes a single attempt
+func retryStartup(name string, timeout, retryInterval time.Duration, connect func(ctx context.Context) error) error {
+	if retryInterval <= 0 {
+		retryInterval = defaultStartupRetryInterval
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Attempts may not outlive the deadline, a single attempt is only bounded by the connect timeout of the client
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := connect(ctx)
+		if err == nil {
+			if attempt > 0 {
+				slog.Info("connection established after retrying", "name", name, "attempts", attempt+1)
+			}
+			return nil
+		}
+
+		if timeout <= 0 || !isTransientStartupError(err) {
+			return err
+		}
+
+		wait := min(retryInterval<<attempt, maxStartupRetryInterval)
+		wait = wait/2 + rand.N(wait/2+1)
+		if time.Now().Add(wait).After(deadline) {
+			return eris.Wrapf(err, "%s still unreachable after %d attempts in %s", name, attempt+1, timeout)
+		}
+
+		slog.Warn("unable to connect, retrying", "name", name, "attempt", attempt+1, "wait", wait, "reason", err)
+		time.Sleep(wait)
+	}
+}
+
+// isTransientStartupError reports whether err means the server isn't reachable yet, such as a refused or reset
+// connection while it starts
+func isTransientStartupError(err error) bool {
+	if classifyMariaDBError(err) == ErrConnectionLost {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
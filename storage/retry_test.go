@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsTransientStartupError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "invalid connection", err: fmt.Errorf("pinging: %w", mysql.ErrInvalidConn), want: true},
+		{name: "server gone", err: &mysql.MySQLError{Number: mariaErrServerGone}, want: true},
+		{name: "connection lost", err: WrapMariaDBError(MariaDBErrors("ping"), &mysql.MySQLError{Number: mariaErrServerLost}), want: true},
+		{name: "refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: true},
+		{name: "reset", err: fmt.Errorf("reading handshake: %w", syscall.ECONNRESET), want: true},
+		{name: "dns", err: &net.DNSError{Err: "no such host", Name: "mariadb", IsNotFound: true}, want: true},
+		{name: "closed by the server", err: io.EOF, want: true},
+		{name: "access denied", err: &mysql.MySQLError{Number: 1045, Message: "Access denied for user"}, want: false},
+		{name: "unknown database", err: &mysql.MySQLError{Number: 1049, Message: "Unknown database"}, want: false},
+		{name: "wrong password", err: errors.New("WRONGPASS invalid username-password pair"), want: false},
+	}
+
+	for _, test := range tests {
+		if got := isTransientStartupError(test.err); got != test.want {
+			t.Errorf("%s: isTransientStartupError(%v) = %t, want %t", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryStartupRetriesTransientErrors(t *testing.T) {
+	attempts := 0
+	err := retryStartup("test", time.Second*5, time.Millisecond, func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("retryStartup: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("connect was called %d times, want 3", attempts)
+	}
+}
+
+func TestRetryStartupReturnsPermanentErrors(t *testing.T) {
+	denied := &mysql.MySQLError{Number: 1045, Message: "Access denied for user"}
+
+	attempts := 0
+	err := retryStartup("test", time.Second*5, time.Millisecond, func(context.Context) error {
+		attempts++
+		return denied
+	})
+	if !errors.Is(err, denied) {
+		t.Fatalf("retryStartup returned %v, want the access denied error", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("connect was called %d times, want 1", attempts)
+	}
+}
@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TracedDriverName is the name of the traced MySQL/MariaDB driver, pools opened with sql.Open(TracedDriverName, dsn)
+// record their statements to the tracer returned by GetDriverQueryTracer
+const TracedDriverName = "mysql-traced"
+
+var driverQueryTracer = NewQueryTracer(0)
+
+func init() {
+	sql.Register(TracedDriverName, &tracedDriver{parent: mysql.MySQLDriver{}, tracer: driverQueryTracer})
+}
+
+// GetDriverQueryTracer returns the tracer of the pools opened through TracedDriverName, the pools of a MariaDB
+// client have their own tracer instead
+func GetDriverQueryTracer() *QueryTracer {
+	return driverQueryTracer
+}
+
+var (
+	_ driver.Driver        = (*tracedDriver)(nil)
+	_ driver.DriverContext = (*tracedDriver)(nil)
+	_ driver.Connector     = (*tracedConnector)(nil)
+
+	_ driver.Conn               = (*tracedConn)(nil)
+	_ driver.ConnBeginTx        = (*tracedConn)(nil)
+	_ driver.ConnPrepareContext = (*tracedConn)(nil)
+	_ driver.ExecerContext      = (*tracedConn)(nil)
+	_ driver.QueryerContext     = (*tracedConn)(nil)
+	_ driver.Pinger             = (*tracedConn)(nil)
+	_ driver.NamedValueChecker  = (*tracedConn)(nil)
+	_ driver.SessionResetter    = (*tracedConn)(nil)
+	_ driver.Validator          = (*tracedConn)(nil)
+
+	_ driver.Stmt              = (*tracedStmt)(nil)
+	_ driver.StmtExecContext   = (*tracedStmt)(nil)
+	_ driver.StmtQueryContext  = (*tracedStmt)(nil)
+	_ driver.NamedValueChecker = (*tracedStmt)(nil)
+
+	_ driver.RowsNextResultSet              = (*tracedRows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*tracedRows)(nil)
+	_ driver.RowsColumnTypeDatabaseTypeName = (*tracedRows)(nil)
+	_ driver.RowsColumnTypeNullable         = (*tracedRows)(nil)
+	_ driver.RowsColumnTypePrecisionScale   = (*tracedRows)(nil)
+	_ driver.RowsColumnTypeLength           = (*tracedRows)(nil)
+)
+
+// tracedDriver wraps a driver so every statement it runs is recorded to a QueryTracer
+type tracedDriver struct {
+	parent driver.Driver
+	tracer *QueryTracer
+}
+
+func (d *tracedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.parent.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedConn{parent: conn, tracer: d.tracer}, nil
+}
+
+func (d *tracedDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	if parent, ok := d.parent.(driver.DriverContext); ok {
+		connector, err := parent.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &tracedConnector{parent: connector, driver: d}, nil
+	}
+
+	return &tracedConnector{dsn: dsn, driver: d}, nil
+}
+
+// tracedConnector wraps the connections of a connector, it is how the pools of a MariaDB client are opened
+type tracedConnector struct {
+	parent driver.Connector
+	dsn    string
+	driver *tracedDriver
+}
+
+// newTracedConnector returns a connector running every statement of the connections of parent through tracer
+func newTracedConnector(parent driver.Connector, tracer *QueryTracer) *tracedConnector {
+	return &tracedConnector{
+		parent: parent,
+		driver: &tracedDriver{parent: parent.Driver(), tracer: tracer},
+	}
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.parent == nil {
+		return c.driver.Open(c.dsn)
+	}
+
+	conn, err := c.parent.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedConn{parent: conn, tracer: c.driver.tracer}, nil
+}
+
+func (c *tracedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type tracedConn struct {
+	parent driver.Conn
+	tracer *QueryTracer
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if parent, ok := c.parent.(driver.ConnPrepareContext); ok {
+		stmt, err = parent.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.parent.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedStmt{parent: stmt, query: query, tracer: c.tracer}, nil
+}
+
+func (c *tracedConn) Close() error {
+	return c.parent.Close()
+}
+
+func (c *tracedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if parent, ok := c.parent.(driver.ConnBeginTx); ok {
+		return parent.BeginTx(ctx, opts)
+	}
+
+	return c.parent.Begin()
+}
+
+// ExecContext records the statement, unless the driver skips it and database/sql falls back to a prepared statement
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	parent, ok := c.parent.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	result, err := parent.ExecContext(ctx, query, args)
+	if errors.Is(err, driver.ErrSkip) {
+		return nil, err
+	}
+	c.tracer.record(ctx, query, time.Since(start), rowsAffected(result, err), err)
+
+	return result, err
+}
+
+// QueryContext records the statement once its rows are closed, unless the driver skips it
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	parent, ok := c.parent.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := parent.QueryContext(ctx, query, args)
+	if errors.Is(err, driver.ErrSkip) {
+		return nil, err
+	}
+	if err != nil {
+		c.tracer.record(ctx, query, time.Since(start), 0, err)
+		return nil, err
+	}
+
+	return &tracedRows{parent: rows, ctx: ctx, query: query, tracer: c.tracer, duration: time.Since(start)}, nil
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if parent, ok := c.parent.(driver.Pinger); ok {
+		return parent.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if parent, ok := c.parent.(driver.NamedValueChecker); ok {
+		return parent.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if parent, ok := c.parent.(driver.SessionResetter); ok {
+		return parent.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if parent, ok := c.parent.(driver.Validator); ok {
+		return parent.IsValid()
+	}
+
+	return true
+}
+
+type tracedStmt struct {
+	parent driver.Stmt
+	query  string
+	tracer *QueryTracer
+}
+
+func (s *tracedStmt) Close() error {
+	return s.parent.Close()
+}
+
+func (s *tracedStmt) NumInput() int {
+	return s.parent.NumInput()
+}
+
+func (s *tracedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *tracedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+
+	var (
+		result driver.Result
+		err    error
+	)
+	if parent, ok := s.parent.(driver.StmtExecContext); ok {
+		result, err = parent.ExecContext(ctx, args)
+	} else {
+		result, err = s.parent.Exec(driverValues(args))
+	}
+	s.tracer.record(ctx, s.query, time.Since(start), rowsAffected(result, err), err)
+
+	return result, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if parent, ok := s.parent.(driver.StmtQueryContext); ok {
+		rows, err = parent.QueryContext(ctx, args)
+	} else {
+		rows, err = s.parent.Query(driverValues(args))
+	}
+	if err != nil {
+		s.tracer.record(ctx, s.query, time.Since(start), 0, err)
+		return nil, err
+	}
+
+	return &tracedRows{parent: rows, ctx: ctx, query: s.query, tracer: s.tracer, duration: time.Since(start)}, nil
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if parent, ok := s.parent.(driver.NamedValueChecker); ok {
+		return parent.CheckNamedValue(nv)
+	}
+	if parent, ok := s.parent.(driver.ColumnConverter); ok {
+		value, err := parent.ColumnConverter(nv.Ordinal - 1).ConvertValue(nv.Value)
+		if err != nil {
+			return err
+		}
+		nv.Value = value
+		return nil
+	}
+
+	return driver.ErrSkip
+}
+
+// tracedRows counts the rows read by the caller, the statement is recorded when they are closed. The duration is
+// the time the server took to answer, the time spent by the caller iterating over the rows isn't included
+type tracedRows struct {
+	parent   driver.Rows
+	ctx      context.Context
+	query    string
+	tracer   *QueryTracer
+	duration time.Duration
+	count    int64
+	err      error
+	closed   bool
+}
+
+func (r *tracedRows) Columns() []string {
+	return r.parent.Columns()
+}
+
+func (r *tracedRows) Close() error {
+	err := r.parent.Close()
+	if !r.closed {
+		r.closed = true
+		r.tracer.record(r.ctx, r.query, r.duration, r.count, r.err)
+	}
+
+	return err
+}
+
+func (r *tracedRows) Next(dest []driver.Value) error {
+	err := r.parent.Next(dest)
+	switch {
+	case err == nil:
+		r.count++
+	case !errors.Is(err, io.EOF):
+		r.err = err
+	}
+
+	return err
+}
+
+func (r *tracedRows) HasNextResultSet() bool {
+	if parent, ok := r.parent.(driver.RowsNextResultSet); ok {
+		return parent.HasNextResultSet()
+	}
+
+	return false
+}
+
+func (r *tracedRows) NextResultSet() error {
+	if parent, ok := r.parent.(driver.RowsNextResultSet); ok {
+		return parent.NextResultSet()
+	}
+
+	return io.EOF
+}
+
+func (r *tracedRows) ColumnTypeScanType(index int) reflect.Type {
+	if parent, ok := r.parent.(driver.RowsColumnTypeScanType); ok {
+		return parent.ColumnTypeScanType(index)
+	}
+
+	return reflect.TypeOf(new(any)).Elem()
+}
+
+func (r *tracedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if parent, ok := r.parent.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return parent.ColumnTypeDatabaseTypeName(index)
+	}
+
+	return ""
+}
+
+func (r *tracedRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if parent, found := r.parent.(driver.RowsColumnTypeNullable); found {
+		return parent.ColumnTypeNullable(index)
+	}
+
+	return false, false
+}
+
+func (r *tracedRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	if parent, found := r.parent.(driver.RowsColumnTypePrecisionScale); found {
+		return parent.ColumnTypePrecisionScale(index)
+	}
+
+	return 0, 0, false
+}
+
+func (r *tracedRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	if parent, found := r.parent.(driver.RowsColumnTypeLength); found {
+		return parent.ColumnTypeLength(index)
+	}
+
+	return 0, false
+}
+
+func rowsAffected(result driver.Result, err error) int64 {
+	if err != nil || result == nil {
+		return 0
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+
+	return rows
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+
+	return named
+}
+
+func driverValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	return values
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	defaultTxMaxRetries   = 3
+	defaultTxRetryBackoff = time.Millisecond * 50
+	maxTxRetryBackoff     = time.Second * 2
+)
+
+// savepointCounter keeps savepoint names unique across nested calls
+var savepointCounter atomic.Uint64
+
+// TxOptions customizes a WithTx call, a nil *TxOptions uses the defaults
+type TxOptions struct {
+	// Isolation level and read only mode of the transaction, ignored when running inside Tx
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+
+	// Tx runs the function inside a savepoint of this existing transaction instead of starting a new one,
+	// a failure only rolls back to the savepoint and is returned to the caller. Retries are left to the outermost call
+	Tx *sql.Tx
+
+	// MaxRetries is how many times the transaction is retried after a deadlock or lock wait timeout, default to 3.
+	// Negative disables retries
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry, doubled on every attempt, default to 50ms
+	RetryBackoff time.Duration
+}
+
+// WithTx runs fn inside a transaction of the default MariaDB client, see MariaDB.WithTx
+func WithTx(ctx context.Context, opts *TxOptions, fn func(tx *sql.Tx) error) error {
+	return defaultMariaDB.Load().WithTx(ctx, opts, fn)
+}
+
+// WithTx runs fn inside a transaction, committing it when fn returns nil and rolling it back otherwise.
+// A panic inside fn rolls the transaction back and is returned as an error.
+//
+// Transactions failing with a MariaDB deadlock or lock wait timeout are retried from the start with an exponential
+// backoff, so fn must not have side effects outside the transaction
+func (m *MariaDB) WithTx(ctx context.Context, opts *TxOptions, fn func(tx *sql.Tx) error) error {
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+
+	if opts.Tx != nil {
+		return withSavepoint(ctx, opts.Tx, fn)
+	}
+
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultTxMaxRetries
+	}
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultTxRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, m.DB(), opts, fn)
+		if err == nil || attempt >= maxRetries || !isRetryableTxError(err) {
+			return err
+		}
+
+		wait := min(backoff<<attempt, maxTxRetryBackoff)
+		// Jitter keeps the transactions that deadlocked together from retrying in lockstep
+		wait = wait/2 + rand.N(wait/2+1)
+		slog.Warn("retrying transaction", "attempt", attempt+1, "wait", wait, "reason", err)
+
+		select {
+		case <-ctx.Done():
+			return eris.Wrap(ctx.Err(), "waiting to retry transaction")
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runTx makes a single attempt at running fn inside a new transaction
+func runTx(ctx context.Context, con *sql.DB, opts *TxOptions, fn func(tx *sql.Tx) error) (err error) {
+	if con == nil {
+		return ErrMariaDBNotInitialized
+	}
+
+	tx, err := con.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return WrapMariaDBError(MariaDBErrorsBeginTx, err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = eris.Errorf("panic inside transaction: %v", r)
+		}
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				slog.Error("unable to rollback transaction", "reason", rbErr)
+			}
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return WrapMariaDBError(MariaDBErrorsCommitTx, err)
+	}
+
+	return nil
+}
+
+// withSavepoint runs fn inside a savepoint of tx, rolling back to it when fn fails or panics
+func withSavepoint(ctx context.Context, tx *sql.Tx, fn func(tx *sql.Tx) error) (err error) {
+	name := fmt.Sprintf("sp_%d", savepointCounter.Add(1))
+
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return WrapMariaDBError(MariaDBErrorsExecStatement, err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = eris.Errorf("panic inside savepoint: %v", r)
+		}
+		if err != nil && classifyMariaDBError(err) != ErrDeadlock {
+			// A deadlock already rolled back the whole transaction, there is no savepoint left to go back to.
+			// The rollback must run even when ctx is what made fn fail
+			if _, rbErr := tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+				slog.Error("unable to rollback to savepoint", "savepoint", name, "reason", rbErr)
+			}
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+		return WrapMariaDBError(MariaDBErrorsExecStatement, err)
+	}
+
+	return nil
+}
+
+// isRetryableTxError reports whether the transaction failed because of a deadlock or a lock wait timeout
+func isRetryableTxError(err error) bool {
+	kind := classifyMariaDBError(err)
+	return kind == ErrDeadlock || kind == ErrLockTimeout
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeTxDriver records the transactions and statements it is given, every statement succeeds
+type fakeTxDriver struct {
+	mutex sync.Mutex
+	log   []string
+}
+
+func (d *fakeTxDriver) record(entry string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.log = append(d.log, entry)
+}
+
+// entries returns the log with the savepoint numbers replaced by N
+func (d *fakeTxDriver) entries() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	entries := make([]string, len(d.log))
+	for i, entry := range d.log {
+		entries[i] = savepointNumberPattern.ReplaceAllString(entry, "sp_N")
+	}
+	return entries
+}
+
+var savepointNumberPattern = regexp.MustCompile(`sp_\d+`)
+
+func (d *fakeTxDriver) Connect(context.Context) (driver.Conn, error) { return &fakeTxConn{driver: d}, nil }
+func (d *fakeTxDriver) Driver() driver.Driver                        { return nil }
+
+type fakeTxConn struct {
+	driver *fakeTxDriver
+}
+
+func (c *fakeTxConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c *fakeTxConn) Close() error              { return nil }
+func (c *fakeTxConn) Begin() (driver.Tx, error) { return c.BeginTx(context.Background(), driver.TxOptions{}) }
+
+func (c *fakeTxConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.driver.record("BEGIN")
+	return c, nil
+}
+
+func (c *fakeTxConn) Commit() error {
+	c.driver.record("COMMIT")
+	return nil
+}
+
+func (c *fakeTxConn) Rollback() error {
+	c.driver.record("ROLLBACK")
+	return nil
+}
+
+func (c *fakeTxConn) ExecContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.driver.record(query)
+	return driver.RowsAffected(0), nil
+}
+
+func newFakeTxMariaDB(t *testing.T) (*MariaDB, *fakeTxDriver) {
+	t.Helper()
+
+	fake := &fakeTxDriver{}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+
+	return &MariaDB{db: db}, fake
+}
+
+func assertTxLog(t *testing.T, fake *fakeTxDriver, want ...string) {
+	t.Helper()
+
+	if got := fake.entries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("statements\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestWithTxCommits(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+
+	err := m.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(context.Background(), "INSERT INTO media (id) VALUES (1)")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+
+	assertTxLog(t, fake, "BEGIN", "INSERT INTO media (id) VALUES (1)", "COMMIT")
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+	failure := errors.New("failure")
+
+	attempts := 0
+	err := m.WithTx(context.Background(), nil, func(*sql.Tx) error {
+		attempts++
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("WithTx returned %v, want the error of fn", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("fn ran %d times, errors other than deadlocks must not be retried", attempts)
+	}
+
+	assertTxLog(t, fake, "BEGIN", "ROLLBACK")
+}
+
+func TestWithTxRetriesDeadlocks(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+
+	attempts := 0
+	err := m.WithTx(context.Background(), &TxOptions{RetryBackoff: time.Millisecond}, func(*sql.Tx) error {
+		attempts++
+		switch attempts {
+		case 1:
+			return WrapMariaDBError(MariaDBErrorsExecStatement, &mysql.MySQLError{Number: mariaErrDeadlock})
+		case 2:
+			return &mysql.MySQLError{Number: mariaErrLockWaitTimeout}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("fn ran %d times, want 3", attempts)
+	}
+
+	assertTxLog(t, fake, "BEGIN", "ROLLBACK", "BEGIN", "ROLLBACK", "BEGIN", "COMMIT")
+}
+
+func TestWithTxGivesUpAfterMaxRetries(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       int
+	}{
+		{maxRetries: 0, want: defaultTxMaxRetries + 1},
+		{maxRetries: 1, want: 2},
+		{maxRetries: -1, want: 1},
+	}
+
+	for _, test := range tests {
+		m, _ := newFakeTxMariaDB(t)
+
+		attempts := 0
+		err := m.WithTx(context.Background(), &TxOptions{MaxRetries: test.maxRetries, RetryBackoff: time.Millisecond}, func(*sql.Tx) error {
+			attempts++
+			return &mysql.MySQLError{Number: mariaErrDeadlock}
+		})
+		if classifyMariaDBError(err) != ErrDeadlock {
+			t.Fatalf("MaxRetries %d: WithTx returned %v, want ErrDeadlock", test.maxRetries, err)
+		}
+		if attempts != test.want {
+			t.Fatalf("MaxRetries %d: fn ran %d times, want %d", test.maxRetries, attempts, test.want)
+		}
+	}
+}
+
+func TestWithTxRecoversPanics(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+
+	err := m.WithTx(context.Background(), nil, func(*sql.Tx) error {
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "panic inside transaction: boom") {
+		t.Fatalf("WithTx returned %v, want the panic", err)
+	}
+
+	assertTxLog(t, fake, "BEGIN", "ROLLBACK")
+}
+
+func TestWithTxSavepoints(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	err := m.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		// A successful nested call releases its savepoint
+		if err := m.WithTx(ctx, &TxOptions{Tx: tx}, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO media (id) VALUES (1)")
+			return err
+		}); err != nil {
+			return err
+		}
+
+		// A failing nested call only rolls back to its savepoint
+		if err := m.WithTx(ctx, &TxOptions{Tx: tx}, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO media (id) VALUES (2)"); err != nil {
+				return err
+			}
+			return failure
+		}); !errors.Is(err, failure) {
+			t.Errorf("nested WithTx returned %v, want the error of fn", err)
+		}
+
+		// A panic as well, and the savepoints nest
+		err := m.WithTx(ctx, &TxOptions{Tx: tx}, func(tx *sql.Tx) error {
+			return m.WithTx(ctx, &TxOptions{Tx: tx}, func(*sql.Tx) error {
+				panic("boom")
+			})
+		})
+		if err == nil || !strings.Contains(err.Error(), "panic inside savepoint: boom") {
+			t.Errorf("nested WithTx returned %v, want the panic", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+
+	assertTxLog(t, fake,
+		"BEGIN",
+		"SAVEPOINT sp_N", "INSERT INTO media (id) VALUES (1)", "RELEASE SAVEPOINT sp_N",
+		"SAVEPOINT sp_N", "INSERT INTO media (id) VALUES (2)", "ROLLBACK TO SAVEPOINT sp_N",
+		"SAVEPOINT sp_N", "SAVEPOINT sp_N", "ROLLBACK TO SAVEPOINT sp_N", "ROLLBACK TO SAVEPOINT sp_N",
+		"COMMIT",
+	)
+}
+
+func TestWithTxSavepointRollbackOutlivesContext(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+
+	err := m.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		err := m.WithTx(ctx, &TxOptions{Tx: tx}, func(tx *sql.Tx) error {
+			cancel()
+			_, err := tx.ExecContext(ctx, "INSERT INTO media (id) VALUES (1)")
+			return err
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("nested WithTx returned %v, want context.Canceled", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+
+	assertTxLog(t, fake, "BEGIN", "SAVEPOINT sp_N", "ROLLBACK TO SAVEPOINT sp_N", "COMMIT")
+}
+
+func TestWithTxSavepointSkipsRollbackAfterDeadlock(t *testing.T) {
+	m, fake := newFakeTxMariaDB(t)
+	ctx := context.Background()
+
+	err := m.WithTx(ctx, &TxOptions{MaxRetries: -1}, func(tx *sql.Tx) error {
+		return m.WithTx(ctx, &TxOptions{Tx: tx}, func(*sql.Tx) error {
+			return &mysql.MySQLError{Number: mariaErrDeadlock}
+		})
+	})
+	if classifyMariaDBError(err) != ErrDeadlock {
+		t.Fatalf("WithTx returned %v, want ErrDeadlock", err)
+	}
+
+	// The deadlock rolled back the whole transaction, the savepoint is gone
+	assertTxLog(t, fake, "BEGIN", "SAVEPOINT sp_N", "ROLLBACK")
+}
@@ -11,16 +11,24 @@ import (
 	"time"
 
 	"github.com/voxtmault/panacea-shared-lib/config"
+	"github.com/voxtmault/panacea-shared-lib/health"
 	"github.com/voxtmault/panacea-shared-lib/websocket-client/types"
 
 	"github.com/gorilla/websocket"
 	"github.com/rotisserie/eris"
 )
 
+// HealthCheckName is the name of the check registered to the health package
+const HealthCheckName = "websocket"
+
 var (
 	conn      *websocket.Conn
 	connMutex sync.RWMutex
 	closing   bool
+
+	// connected is false while the client is reconnecting, conn still holds the broken connection then
+	connected bool
+	lastErr   error
 )
 
 func connect(cfg *config.WebsocketConfig) (*websocket.Conn, error) {
@@ -58,12 +66,14 @@ func listenForMessages() {
 					slog.Error("unable to read message from the websocket server", "reason", err)
 				}
 
-				connMutex.RLock()
+				connMutex.Lock()
 				if closing {
-					connMutex.RUnlock()
+					connMutex.Unlock()
 					return
 				}
-				connMutex.RUnlock()
+				connected = false
+				lastErr = err
+				connMutex.Unlock()
 
 				// Attempt to reconnect
 				index := 1
@@ -81,6 +91,9 @@ func listenForMessages() {
 					newConn, err := connect(&cfg)
 					if err != nil {
 						slog.Error("failed to reconnect to the websocket server", "reason", err)
+						connMutex.Lock()
+						lastErr = err
+						connMutex.Unlock()
 						time.Sleep(reconnectInterval)
 					} else {
 						slog.Info("reconnected to the websocket server", "attempts", index)
@@ -91,6 +104,8 @@ func listenForMessages() {
 							return
 						}
 						conn = newConn
+						connected = true
+						lastErr = nil
 						connMutex.Unlock()
 						break
 					}
@@ -148,8 +163,12 @@ func InitWebsocketClient() error {
 	connMutex.Lock()
 	conn = newConn
 	closing = false
+	connected = true
+	lastErr = nil
 	connMutex.Unlock()
 
+	health.Register(HealthCheckName, health.Readiness, checkConnection)
+
 	// Start a goroutine to listen for messages from the WebSocket server
 	go listenForMessages()
 
@@ -164,9 +183,12 @@ func CloseWebsocketClient() error {
 		return nil // Already closing or closed
 	}
 	closing = true
+	connected = false
 	c := conn
 	connMutex.Unlock()
 
+	health.Unregister(HealthCheckName)
+
 	if c == nil {
 		return nil // Nothing to close
 	}
@@ -184,6 +206,32 @@ func CloseWebsocketClient() error {
 	return c.Close()
 }
 
+// IsConnected reports whether the client holds a working connection to the websocket server,
+// it is false while reconnecting and after the client has been closed
+func IsConnected() bool {
+	connMutex.RLock()
+	defer connMutex.RUnlock()
+	return conn != nil && connected && !closing
+}
+
+// checkConnection is the health check of the client, it fails with the reason of the last disconnection
+func checkConnection(ctx context.Context) error {
+	connMutex.RLock()
+	defer connMutex.RUnlock()
+
+	if conn == nil || closing {
+		return eris.New("websocket client is not running")
+	}
+	if !connected {
+		if lastErr != nil {
+			return eris.Wrap(lastErr, "websocket client is reconnecting")
+		}
+		return eris.New("websocket client is reconnecting")
+	}
+
+	return nil
+}
+
 func GetWSConn() *websocket.Conn {
 	connMutex.RLock()
 	defer connMutex.RUnlock()